@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/arthur-silva-sacramento/Sistema_de_upload_e_compartilhamento/internal/node"
+)
+
+// Client of a node's JSON API, used by the commands given -server
+type APIClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// Create a client for the address of a node's web interface, such as
+// localhost:8081 or https://node.example/uploads
+func NewAPIClient(server string) (*APIClient, error) {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	parsed, err := url.Parse(server)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid server address: %q", server)
+	}
+	return &APIClient{
+		BaseURL:    strings.TrimSuffix(parsed.String(), "/"),
+		HTTPClient: http.DefaultClient,
+	}, nil
+}
+
+// Send a request, decoding the JSON response into result. Error responses
+// are returned as errors with the message sent by the node.
+func (c *APIClient) do(request *http.Request, result interface{}) error {
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error contacting %s: %v", c.BaseURL, err)
+	}
+	defer response.Body.Close()
+
+	if err := checkResponse(response); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("Error decoding response: %v", err)
+	}
+	return nil
+}
+
+// Turn an error response into an error
+func checkResponse(response *http.Response) error {
+	if response.StatusCode < 300 {
+		return nil
+	}
+	var apiError struct {
+		Error string `json:"error"`
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if json.Unmarshal(body, &apiError) == nil && apiError.Error != "" {
+		return fmt.Errorf("%s (%s)", apiError.Error, response.Status)
+	}
+	return fmt.Errorf("Unexpected response: %s", response.Status)
+}
+
+// Build a request to an API route
+func (c *APIClient) newRequest(method string, route string, query url.Values, body io.Reader) (*http.Request, error) {
+	target := c.BaseURL + node.APIPrefix + route
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return http.NewRequest(method, target, body)
+}
+
+// Upload content, or text content when there is none, like the HTML form
+func (c *APIClient) Put(upload *node.UploadRequest) (*node.UploadResult, error) {
+	fields := map[string]string{
+		"category": upload.Category,
+		"btc":      upload.BTC,
+		"reply":    upload.ReplyTo,
+	}
+	if upload.Metadata != nil {
+		fields["user"] = upload.Metadata.User
+		fields["title"] = upload.Metadata.Title
+		fields["description"] = upload.Metadata.Description
+		fields["url"] = upload.Metadata.URL
+	}
+
+	var request *http.Request
+	var err error
+	if upload.Content != nil {
+		// Content is streamed as the raw body, the fields go in the query
+		query := url.Values{}
+		for key, value := range fields {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		query.Set("filename", upload.OriginalFileName)
+		if upload.FileExtension != "" {
+			query.Set("extension", upload.FileExtension)
+		}
+
+		request, err = c.newRequest(http.MethodPost, "objects", query, upload.Content)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/octet-stream")
+		if upload.Size > 0 {
+			request.ContentLength = upload.Size
+		}
+	} else {
+		// Text content is sent as the text_content form field
+		fields["text_content"] = upload.TextContent
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for key, value := range fields {
+			writer.WriteField(key, value)
+		}
+		writer.Close()
+
+		request, err = c.newRequest(http.MethodPost, "objects", nil, &body)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+	}
+
+	var uploadResult node.UploadResult
+	if err := c.do(request, &uploadResult); err != nil {
+		return nil, err
+	}
+	return &uploadResult, nil
+}
+
+// Describe a stored object, with its owner and metadata records
+func (c *APIClient) Object(fileHash string) (*node.ObjectResponse, error) {
+	request, err := c.newRequest(http.MethodGet, "objects/"+url.PathEscape(fileHash), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var object node.ObjectResponse
+	if err := c.do(request, &object); err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+// Describe every stored object
+func (c *APIClient) Objects() ([]node.ObjectResponse, error) {
+	request, err := c.newRequest(http.MethodGet, "objects", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var objects []node.ObjectResponse
+	if err := c.do(request, &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// List the objects of a category
+func (c *APIClient) Category(category string) (*node.CategoryResponse, error) {
+	request, err := c.newRequest(http.MethodGet, "categories/"+url.PathEscape(category), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var response node.CategoryResponse
+	if err := c.do(request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Copy the content of a stored object, checking it against the object's
+// hash. The content is written as it arrives, so on a mismatch dst already
+// holds it and the error tells it must be discarded.
+func (c *APIClient) Download(object *node.ObjectResponse, dst io.Writer) error {
+	response, err := c.HTTPClient.Get(c.BaseURL + "/" + object.FilePath)
+	if err != nil {
+		return fmt.Errorf("Error contacting %s: %v", c.BaseURL, err)
+	}
+	defer response.Body.Close()
+
+	if err := checkResponse(response); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, hash), response.Body); err != nil {
+		return fmt.Errorf("Error downloading %s: %v", object.FilePath, err)
+	}
+	if received := hex.EncodeToString(hash.Sum(nil)); received != strings.ToLower(object.FileHash) {
+		return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", object.FilePath, object.FileHash, received)
+	}
+	return nil
+}
+
+// Make the node sync with peers given as sync form lines, or with its
+// scheduled peers when none are given
+func (c *APIClient) Sync(peerLines []string) ([]node.SyncResult, error) {
+	body, _ := json.Marshal(node.SyncRequest{Peers: peerLines})
+	request, err := c.newRequest(http.MethodPost, "sync", nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	var results []node.SyncResult
+	if err := c.do(request, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
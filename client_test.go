@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arthur-silva-sacramento/Sistema_de_upload_e_compartilhamento/internal/node"
+)
+
+// Downloads are checked against the hash of the object, whatever the node
+// sends
+func TestDownloadChecksHash(t *testing.T) {
+	content := "stored content"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer server.Close()
+
+	client, err := NewAPIClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	fileHash := hex.EncodeToString(sum[:])
+	otherSum := sha256.Sum256([]byte("other content"))
+
+	tests := []struct {
+		fileHash string
+		valid    bool
+	}{
+		{fileHash, true},
+		{strings.ToUpper(fileHash), true},
+		{hex.EncodeToString(otherSum[:]), false},
+	}
+	for _, test := range tests {
+		var dst bytes.Buffer
+		object := &node.ObjectResponse{FileHash: test.fileHash, FilePath: "data/" + test.fileHash + "/" + test.fileHash + ".txt"}
+		if err := client.Download(object, &dst); test.valid != (err == nil) {
+			t.Errorf("Download of %s = %v, want valid %v", test.fileHash, err, test.valid)
+		}
+	}
+}
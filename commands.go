@@ -0,0 +1,418 @@
+// Upload server storing content by SHA-256 in categories, serving it over
+// HTTP and syncing it with peers. Subcommands choose what the binary runs.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/arthur-silva-sacramento/Sistema_de_upload_e_compartilhamento/internal/node"
+)
+
+// Usage of the -server flag of the client commands
+const serverUsage = "address of a node's web interface, to use its API instead of the local store"
+
+// Subcommand of the binary
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+// Subcommands, "serve" being the default
+var commands = []command{
+	{"serve", "run the web interface and the P2P server", func(args []string) error { return runServe("serve", args, false) }},
+	{"serve-http-only", "run the web interface without the P2P server", func(args []string) error { return runServe("serve-http-only", args, true) }},
+	{"minimal", "run the simple upload form of the original FileUploadServer", runMinimal},
+	{"sync", "sync with the given peers, or the ones in the peers file", runSync},
+	{"put", "store a file, standard input or -text in a category", runPut},
+	{"get", "write stored content to standard output", runGet},
+	{"ls", "list a category, or every stored object", runList},
+	{"reindex", "convert old index pages and rebuild the search index", runReindex},
+	{"migrate-index", "same as reindex", runReindex},
+	{"repair-index", "render every index page again from its entries, escaping them and keeping the old page", runRepairIndex},
+}
+
+// Run a subcommand by name
+func runCommand(name string, args []string) error {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+	if name == "help" {
+		printUsage()
+		return flag.ErrHelp
+	}
+	printUsage()
+	return fmt.Errorf("Unknown command %q", name)
+}
+
+// List the subcommands
+func printUsage() {
+	program := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags] [arguments]\n\nCommands:\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nput, get, ls and sync work on another node with -server <address>.\n")
+	fmt.Fprintf(os.Stderr, "Run '%s <command> -h' for the flags of a command.\n", program)
+}
+
+// Flags of a subcommand taking the given arguments, to be parsed by
+// parseCommand
+func commandFlags(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] %s\n", filepath.Base(os.Args[0]), name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Parse a subcommand's arguments along with the setting flags, loading the
+// settings, and check the number of arguments left
+func parseCommand(flags *flag.FlagSet, args []string, minArgs int, maxArgs int) error {
+	if err := node.LoadConfig(flags, args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+	if flags.NArg() > maxArgs && maxArgs >= 0 {
+		return fmt.Errorf("Unexpected argument %q", flags.Arg(maxArgs))
+	}
+	if flags.NArg() < minArgs {
+		flags.Usage()
+		return fmt.Errorf("Missing arguments")
+	}
+	return nil
+}
+
+// Write a value as JSON to standard output
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// sync [flags] [peer ...]
+func runSync(args []string) error {
+	flags := commandFlags("sync", "[peer ...]")
+	server := flags.String("server", "", serverUsage)
+	peersFile := flags.String("peers", "", "file of peers to sync, one per line, - for standard input")
+	if err := parseCommand(flags, args, 0, -1); err != nil {
+		return err
+	}
+
+	// Peers are given like the lines of the sync form
+	lines := flags.Args()
+	if *peersFile != "" {
+		fileLines, err := readPeerLines(*peersFile)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fileLines...)
+	}
+
+	var results []node.SyncResult
+	if *server != "" {
+		// The node syncs, with its scheduled peers when none are given
+		client, err := NewAPIClient(*server)
+		if err != nil {
+			return err
+		}
+		if results, err = client.Sync(lines); err != nil {
+			return err
+		}
+	} else {
+		node.OpenStoreForUpdates()
+		if err := node.LoadPeerState(); err != nil {
+			return err
+		}
+
+		// Interrupting cancels the syncs, keeping partial downloads
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		if len(lines) > 0 {
+			results = node.SyncPeerLines(ctx, lines)
+		} else {
+			results = node.SyncPeers(ctx, node.ScheduledPeers())
+		}
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("No peers to sync: give them as arguments or list them in %s", node.Settings().PeersFile)
+	}
+
+	if err := printJSON(results); err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Status != "success" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Sync failed with %d of %d peers", failed, len(results))
+	}
+	return nil
+}
+
+// Read sync form lines from a file, skipping blank lines and # comments
+func readPeerLines(fileName string) ([]string, error) {
+	var content []byte
+	var err error
+	if fileName == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(fileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading peers: %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// put [flags] <file|->
+func runPut(args []string) error {
+	flags := commandFlags("put", "<file|->")
+	category := flags.String("category", "", "category of the content, or its hash")
+	text := flags.String("text", "", "text content to store instead of a file")
+	name := flags.String("name", "", "name listed in the indexes (default the file name)")
+	extension := flags.String("extension", "", "extension of the stored file (default the name's)")
+	btc := flags.String("btc", "", "BTC owner information")
+	reply := flags.String("reply", "", "hash of the content replied to")
+	flags.String("user", "", "metadata user")
+	flags.String("title", "", "metadata title")
+	flags.String("description", "", "metadata description")
+	flags.String("url", "", "metadata URL")
+	server := flags.String("server", "", serverUsage)
+	if err := parseCommand(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	upload := &node.UploadRequest{
+		OriginalFileName: *name,
+		FileExtension:    strings.TrimPrefix(*extension, "."),
+		TextContent:      *text,
+		Category:         *category,
+		BTC:              *btc,
+		ReplyTo:          *reply,
+		Metadata: node.MetadataFromValues(func(key string) string {
+			return flags.Lookup(key).Value.String()
+		}),
+	}
+
+	switch source := flags.Arg(0); {
+	case source != "" && *text != "":
+		flags.Usage()
+		return fmt.Errorf("Give either a file, - for standard input, or -text, not both")
+	case source == "-":
+		upload.Content, upload.Size = node.PeekContent(os.Stdin)
+		if upload.OriginalFileName == "" {
+			upload.OriginalFileName = "stdin"
+			if upload.FileExtension != "" {
+				upload.OriginalFileName += "." + upload.FileExtension
+			}
+		}
+	case source != "":
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		upload.Content = file
+		upload.Size = info.Size()
+		if upload.OriginalFileName == "" {
+			upload.OriginalFileName = filepath.Base(source)
+		}
+	case *text == "":
+		flags.Usage()
+		return fmt.Errorf("Give a file, - for standard input, or -text")
+	}
+
+	var uploadResult *node.UploadResult
+	var err error
+	if *server != "" {
+		client, clientErr := NewAPIClient(*server)
+		if clientErr != nil {
+			return clientErr
+		}
+		uploadResult, err = client.Put(upload)
+	} else {
+		node.OpenStoreForUpdates()
+		uploadResult, err = node.ProcessUpload(upload)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(uploadResult)
+}
+
+// get [flags] <hash>
+func runGet(args []string) error {
+	flags := commandFlags("get", "<hash>")
+	info := flags.Bool("info", false, "print the object description as JSON instead of its content")
+	server := flags.String("server", "", serverUsage)
+	if err := parseCommand(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	fileHash := strings.ToLower(flags.Arg(0))
+	if !node.IsValidSHA256(fileHash) {
+		return fmt.Errorf("Invalid hash: %s", fileHash)
+	}
+
+	if *server != "" {
+		client, err := NewAPIClient(*server)
+		if err != nil {
+			return err
+		}
+		object, err := client.Object(fileHash)
+		if err != nil {
+			return err
+		}
+		if *info {
+			return printJSON(object)
+		}
+		return client.Download(object, os.Stdout)
+	}
+
+	node.OpenStore()
+	object, err := node.FindObject(fileHash)
+	if err != nil {
+		return fmt.Errorf("Object not found: %s", fileHash)
+	}
+	if *info {
+		node.AttachObjectRecords(object)
+		return printJSON(object)
+	}
+
+	file, err := object.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
+
+// ls [flags] [category]
+func runList(args []string) error {
+	flags := commandFlags("ls", "[category]")
+	server := flags.String("server", "", serverUsage)
+	if err := parseCommand(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	if *server != "" {
+		client, err := NewAPIClient(*server)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			objects, err := client.Objects()
+			if err != nil {
+				return err
+			}
+			return printJSON(objects)
+		}
+		response, err := client.Category(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return printJSON(response)
+	}
+
+	node.OpenStore()
+	if flags.NArg() == 0 {
+		objects, err := node.ListObjects()
+		if err != nil {
+			return err
+		}
+		return printJSON(objects)
+	}
+
+	response, err := node.DescribeCategory(node.CheckSHA256(flags.Arg(0)))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Category not found: %s", flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(response)
+}
+
+// reindex
+func runReindex(args []string) error {
+	flags := commandFlags("reindex", "")
+	if err := parseCommand(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	node.OpenStore()
+	if err := node.MigrateIndexes(); err != nil {
+		return fmt.Errorf("Error migrating indexes: %v", err)
+	}
+	if err := node.RebuildSearchIndex(); err != nil {
+		return fmt.Errorf("Error rebuilding search index: %v", err)
+	}
+	log.Printf("Search index rebuilt")
+	return nil
+}
+
+// repair-index
+func runRepairIndex(args []string) error {
+	flags := commandFlags("repair-index", "")
+	dryRun := flags.Bool("dry-run", false, "list the pages that would be rendered again without changing them")
+	if err := parseCommand(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	node.OpenStore()
+	if err := node.RepairIndexes(*dryRun); err != nil {
+		return fmt.Errorf("Error repairing indexes: %v", err)
+	}
+	return nil
+}
+
+// serve and serve-http-only
+func runServe(name string, args []string, httpOnly bool) error {
+	flags := commandFlags(name, "")
+	if err := parseCommand(flags, args, 0, 0); err != nil {
+		return err
+	}
+	return node.Serve(httpOnly)
+}
+
+// minimal
+func runMinimal(args []string) error {
+	flags := commandFlags("minimal", "")
+	if err := parseCommand(flags, args, 0, 0); err != nil {
+		return err
+	}
+	return node.ServeMinimal()
+}
@@ -0,0 +1,3 @@
+module github.com/arthur-silva-sacramento/Sistema_de_upload_e_compartilhamento
+
+go 1.21
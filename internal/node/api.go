@@ -0,0 +1,343 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Prefix of the JSON API routes
+const APIPrefix = "/api/v1/"
+
+// Stored object description returned by the API
+type ObjectResponse struct {
+	FileHash    string    `json:"file_hash"`
+	Extension   string    `json:"extension"`
+	ContentType string    `json:"content_type,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Size        int64     `json:"size"`
+	FilePath    string    `json:"file_path"`
+	FileIndex   string    `json:"file_index"`
+	BTC         string    `json:"btc,omitempty"`
+	Metadata    *Metadata `json:"metadata,omitempty"`
+}
+
+// Open the content of an object
+func (o *ObjectResponse) Open() (io.ReadSeekCloser, error) {
+	return store.Get(o.FilePath)
+}
+
+// Category listing returned by the API
+type CategoryResponse struct {
+	CategoryHash  string           `json:"category_hash"`
+	CategoryIndex string           `json:"category_index"`
+	Objects       []ObjectResponse `json:"objects"`
+}
+
+// Write a JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// Write a JSON error response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// Handler for the JSON API
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	route := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/")
+	parts := strings.Split(route, "/")
+
+	switch {
+	case route == "objects":
+		switch r.Method {
+		case http.MethodPost:
+			apiPutObject(w, r)
+		case http.MethodGet:
+			apiListObjects(w, r)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case len(parts) == 2 && parts[0] == "objects":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		apiGetObject(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "categories":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		apiGetCategory(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "threads":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		apiGetThread(w, r, parts[1])
+	case route == "search":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		apiSearch(w, r)
+	case route == "sync":
+		switch r.Method {
+		case http.MethodGet:
+			apiSyncStatus(w, r)
+		case http.MethodPost:
+			apiRunSync(w, r)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	default:
+		writeJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// POST /api/v1/objects
+//
+// Accepts either the same multipart fields as the HTML form or a raw body,
+// in which case the other fields come from the query string.
+func apiPutObject(w http.ResponseWriter, r *http.Request) {
+	ensureDirectoriesExist()
+
+	// Refuse bodies over the size limits, reading forms without holding the
+	// content in memory
+	file, err := readUploadRequest(w, r, "uploaded_file")
+	if err != nil {
+		writeJSONError(w, uploadErrorStatus(err), err.Error())
+		return
+	}
+	if file != nil {
+		defer file.Remove()
+	}
+
+	var upload *UploadRequest
+	if isMultipartRequest(r) {
+		upload = &UploadRequest{
+			Category:    r.FormValue("category"),
+			TextContent: r.FormValue("text_content"),
+			BTC:         r.FormValue("btc"),
+			ReplyTo:     r.FormValue("reply"),
+			Metadata:    MetadataFromValues(r.FormValue),
+		}
+
+		if file != nil {
+			upload.Content = file
+			upload.Size = file.Size()
+			upload.OriginalFileName = file.FileName
+		}
+	} else {
+		query := r.URL.Query()
+		upload = &UploadRequest{
+			Content:          r.Body,
+			Size:             r.ContentLength,
+			OriginalFileName: query.Get("filename"),
+			FileExtension:    strings.TrimPrefix(query.Get("extension"), "."),
+			Category:         query.Get("category"),
+			BTC:              query.Get("btc"),
+			ReplyTo:          query.Get("reply"),
+			Metadata:         MetadataFromValues(query.Get),
+		}
+		if upload.OriginalFileName == "" {
+			upload.OriginalFileName = "upload"
+			if upload.FileExtension != "" {
+				upload.OriginalFileName += "." + upload.FileExtension
+			}
+		}
+
+		// Chunked bodies have no length, so look ahead for at least one byte
+		if upload.Size < 0 {
+			upload.Content, upload.Size = PeekContent(r.Body)
+		}
+	}
+
+	uploadResult, err := ProcessUpload(upload)
+	if err != nil {
+		writeJSONError(w, uploadErrorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, uploadResult)
+}
+
+// Build metadata from request values
+func MetadataFromValues(get func(string) string) *Metadata {
+	return &Metadata{
+		User:        get("user"),
+		Title:       get("title"),
+		Description: get("description"),
+		URL:         get("url"),
+	}
+}
+
+// Check whether a body of unknown length is empty, returning a reader with
+// the peeked byte put back and -1 as the size when it isn't
+func PeekContent(body io.Reader) (io.Reader, int64) {
+	first := make([]byte, 1)
+	n, _ := io.ReadFull(body, first)
+	if n == 0 {
+		return body, 0
+	}
+	return io.MultiReader(bytes.NewReader(first), body), -1
+}
+
+// GET /api/v1/objects
+func apiListObjects(w http.ResponseWriter, r *http.Request) {
+	objects, err := ListObjects()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, objects)
+}
+
+// GET /api/v1/objects/{hash}
+func apiGetObject(w http.ResponseWriter, r *http.Request, fileHash string) {
+	fileHash = strings.ToLower(fileHash)
+	if !IsValidSHA256(fileHash) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid hash")
+		return
+	}
+
+	object, err := FindObject(fileHash)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Object not found")
+		return
+	}
+
+	AttachObjectRecords(object)
+	writeJSON(w, http.StatusOK, object)
+}
+
+// Attach owner and metadata records when present
+func AttachObjectRecords(object *ObjectResponse) {
+	if btcInfo, err := store.ReadFile(path.Join(OwnersDir, object.FileHash)); err == nil {
+		object.BTC = string(btcInfo)
+	}
+	if metadataBytes, err := store.ReadFile(path.Join(MetadataDir, object.FileHash+".json")); err == nil {
+		var metadata Metadata
+		if json.Unmarshal(metadataBytes, &metadata) == nil {
+			object.Metadata = &metadata
+		}
+	}
+}
+
+// GET /api/v1/categories/{hash}
+func apiGetCategory(w http.ResponseWriter, r *http.Request, category string) {
+	response, err := DescribeCategory(CheckSHA256(category))
+	if os.IsNotExist(err) {
+		writeJSONError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// List the objects of a category
+func DescribeCategory(categoryHash string) (*CategoryResponse, error) {
+	index, _, err := readIndex(categoryHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(index.Entries) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	response := &CategoryResponse{
+		CategoryHash:  categoryHash,
+		CategoryIndex: indexHTMLPath(categoryHash),
+		Objects:       []ObjectResponse{},
+	}
+	for _, entry := range index.Entries {
+		object, err := describeObject(entry.FileHash, entry.Extension)
+		if err != nil {
+			continue
+		}
+		object.Name = entry.Name
+		response.Objects = append(response.Objects, *object)
+	}
+	return response, nil
+}
+
+// Find a stored blob by its hash, in the content's own folder
+func FindObject(fileHash string) (*ObjectResponse, error) {
+	fileNames, err := store.ReadDir(path.Join(UploadDirBase, fileHash))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileName := range fileNames {
+		if strings.HasPrefix(fileName, fileHash+".") {
+			return describeObject(fileHash, strings.TrimPrefix(fileName, fileHash+"."))
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Describe every stored blob
+func ListObjects() ([]ObjectResponse, error) {
+	fileList, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []ObjectResponse{}
+	for _, filePath := range fileList {
+		fileHash := path.Base(path.Dir(filePath))
+		fileName := path.Base(filePath)
+		if path.Dir(path.Dir(filePath)) != UploadDirBase || !IsValidSHA256(fileHash) || !strings.HasPrefix(fileName, fileHash+".") {
+			continue
+		}
+		object, err := describeObject(fileHash, strings.TrimPrefix(fileName, fileHash+"."))
+		if err != nil {
+			continue
+		}
+		objects = append(objects, *object)
+	}
+	return objects, nil
+}
+
+// Describe a stored blob
+func describeObject(fileHash string, fileExtension string) (*ObjectResponse, error) {
+	filePath := blobPath(fileHash, fileExtension)
+	info, err := store.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &ObjectResponse{
+		FileHash:  fileHash,
+		Extension: fileExtension,
+		Size:      info.Size,
+		FilePath:  filePath,
+		FileIndex: indexHTMLPath(fileHash),
+	}
+
+	// The type detected on upload is listed in the content's own index
+	if index, _, err := readIndex(fileHash); err == nil {
+		for _, entry := range index.Entries {
+			if entry.FileHash == fileHash && entry.Extension == fileExtension && entry.ContentType != "" {
+				object.ContentType = entry.ContentType
+			}
+		}
+	}
+	return object, nil
+}
@@ -0,0 +1,84 @@
+package node
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Send a request to the JSON API, returning its status and decoded body
+func apiRequest(t *testing.T, method string, target string, body io.Reader) (int, map[string]interface{}) {
+	request := httptest.NewRequest(method, APIPrefix+target, body)
+	recorder := httptest.NewRecorder()
+	apiHandler(recorder, request)
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("%s %s answered with %q, want JSON", method, target, contentType)
+	}
+	var response map[string]interface{}
+	if strings.HasPrefix(strings.TrimSpace(recorder.Body.String()), "{") {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Errorf("%s %s answered invalid JSON: %v", method, target, err)
+		}
+	}
+	return recorder.Code, response
+}
+
+func TestAPIStatus(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+
+	status, created := apiRequest(t, http.MethodPost, "objects?category=notes&extension=txt", strings.NewReader("api content"))
+	if status != http.StatusCreated {
+		t.Fatalf("POST objects answered %d: %v", status, created)
+	}
+	fileHash, _ := created["file_hash"].(string)
+	if fileHash != sha256Hash("api content") {
+		t.Fatalf("POST objects answered the hash %q", fileHash)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "objects", "", http.StatusOK},
+		{http.MethodGet, "objects/" + fileHash, "", http.StatusOK},
+		{http.MethodGet, "objects/" + strings.ToUpper(fileHash), "", http.StatusOK},
+		{http.MethodGet, "categories/notes", "", http.StatusOK},
+		{http.MethodGet, "threads/" + fileHash, "", http.StatusOK},
+		{http.MethodGet, "search?q=notes", "", http.StatusOK},
+
+		{http.MethodPost, "objects", "", http.StatusBadRequest},
+		{http.MethodPost, "objects?extension=txt", "no category", http.StatusBadRequest},
+		{http.MethodGet, "objects/not-a-hash", "", http.StatusBadRequest},
+		{http.MethodGet, "threads/not-a-hash", "", http.StatusBadRequest},
+
+		{http.MethodGet, "objects/" + sha256Hash("missing"), "", http.StatusNotFound},
+		{http.MethodGet, "categories/missing", "", http.StatusNotFound},
+		{http.MethodGet, "unknown", "", http.StatusNotFound},
+		{http.MethodGet, "objects/" + fileHash + "/extra", "", http.StatusNotFound},
+
+		{http.MethodDelete, "objects", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, "objects/" + fileHash, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "categories/notes", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "threads/" + fileHash, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "search", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "sync", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		status, response := apiRequest(t, test.method, test.target, strings.NewReader(test.body))
+		if status != test.status {
+			t.Errorf("%s %s answered %d, want %d", test.method, test.target, status, test.status)
+			continue
+		}
+		if message, _ := response["error"].(string); (status >= 400) != (message != "") {
+			t.Errorf("%s %s answered %d with the error %q", test.method, test.target, status, message)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration sources
+const (
+	// Settings file read on start, unless another one is given
+	DefaultConfigFile = "config.json"
+
+	// Prefix of the environment variables overriding settings
+	ConfigEnvPrefix = "UPLOADER_"
+)
+
+// Server settings. Defaults are overridden by the config file, then by
+// environment variables, then by command-line flags.
+type Config struct {
+	HTTPPort          string   `json:"http_port"`
+	P2PPort           string   `json:"p2p_port"`
+	DataDir           string   `json:"data_dir"`
+	OwnersDir         string   `json:"owners_dir"`
+	MetadataDir       string   `json:"metadata_dir"`
+	BufferSize        int      `json:"buffer_size"`        // Bytes copied at a time in transfers
+	BlockedExtensions []string `json:"blocked_extensions"` // Extensions refused on upload
+	MaxUploadSize     int64    `json:"max_upload_size"`    // Largest upload in bytes, 0 for no limit
+
+	// Largest upload in bytes by category text or hash, replacing
+	// MaxUploadSize. Kept by category hash once loaded.
+	CategoryMaxUploadSize map[string]int64 `json:"category_max_upload_size"`
+
+	// Content policy. Types are detected from the content and may end in
+	// /* to match a whole family. Empty allow lists allow everything.
+	AllowedExtensions []string `json:"allowed_extensions"`
+	AllowedTypes      []string `json:"allowed_types"`
+	BlockedTypes      []string `json:"blocked_types"`
+
+	// Separate origin serving raw content, so uploaded pages and scripts
+	// can't act on the web interface. Off when SandboxPort is empty.
+	// SandboxURL is the public address of that port, by default the host
+	// of the web interface on SandboxPort.
+	SandboxPort string `json:"sandbox_port"`
+	SandboxURL  string `json:"sandbox_url"`
+
+	// Node state kept outside the store
+	SearchDir      string `json:"search_dir"`       // Search index
+	PartialDir     string `json:"partial_dir"`      // Interrupted P2P transfers
+	TLSDir         string `json:"tls_dir"`          // Certificate and key of the P2P port
+	PeersFile      string `json:"peers_file"`       // Peer allowlist and P2P settings
+	SyncStateFile  string `json:"sync_state_file"`  // Sync schedule and history
+	KnownPeersFile string `json:"known_peers_file"` // Peers learned through discovery
+
+	// Limits of the P2P listener, replacing the ones of the peers file.
+	// Zero or empty leaves those in effect.
+	P2PMaxPathLength       int    `json:"p2p_max_path_length"`
+	P2PMaxFileSize         int64  `json:"p2p_max_file_size"`
+	P2PReadTimeout         string `json:"p2p_read_timeout"`
+	P2PWriteTimeout        string `json:"p2p_write_timeout"`
+	P2PMaxConnections      int    `json:"p2p_max_connections"`
+	P2PMaxConnectionsPerIP int    `json:"p2p_max_connections_per_ip"`
+
+	P2PMaxPartials            int   `json:"p2p_max_partials"`
+	P2PMaxPartialBytes        int64 `json:"p2p_max_partial_bytes"`
+	P2PMaxPartialsPerPeer     int   `json:"p2p_max_partials_per_peer"`
+	P2PMaxPartialBytesPerPeer int64 `json:"p2p_max_partial_bytes_per_peer"`
+}
+
+// Settings that can be overridden, by their key in the config file. The
+// environment variable is the key in uppercase with ConfigEnvPrefix, the
+// flag the key with dashes.
+var configSettings = []struct {
+	key   string
+	usage string
+}{
+	{"http_port", "port of the web interface"},
+	{"p2p_port", "port of the P2P server"},
+	{"data_dir", "directory of content, categories and indexes"},
+	{"owners_dir", "directory of BTC owner records"},
+	{"metadata_dir", "directory of content metadata"},
+	{"buffer_size", "bytes copied at a time in transfers"},
+	{"blocked_extensions", "comma separated extensions refused on upload"},
+	{"max_upload_size", "largest upload in bytes, 0 for no limit"},
+	{"category_max_upload_size", "comma separated category=bytes limits replacing max_upload_size"},
+	{"allowed_extensions", "comma separated extensions accepted on upload, empty for all"},
+	{"allowed_types", "comma separated content types accepted on upload, empty for all"},
+	{"blocked_types", "comma separated content types refused on upload"},
+	{"sandbox_port", "port serving raw content apart from the web interface, empty for none"},
+	{"sandbox_url", "public address of the sandbox port (default the web interface's host)"},
+	{"search_dir", "directory of the search index"},
+	{"partial_dir", "directory of interrupted P2P transfers"},
+	{"tls_dir", "directory of the P2P certificate and key"},
+	{"peers_file", "peer allowlist and P2P settings"},
+	{"sync_state_file", "sync schedule and history"},
+	{"known_peers_file", "peers learned through discovery"},
+	{"p2p_max_path_length", "longest path a peer may send, 0 for the peers file's"},
+	{"p2p_max_file_size", "largest file a peer may upload in bytes, 0 for the peers file's"},
+	{"p2p_read_timeout", "longest wait for a peer to send data, like 2m"},
+	{"p2p_write_timeout", "longest wait for a peer to accept data, like 2m"},
+	{"p2p_max_connections", "open P2P connections in total, 0 for the peers file's"},
+	{"p2p_max_connections_per_ip", "open P2P connections from a single IP, 0 for the peers file's"},
+	{"p2p_max_partials", "interrupted uploads kept to be resumed, 0 for the peers file's"},
+	{"p2p_max_partial_bytes", "bytes of interrupted uploads kept, 0 for the peers file's"},
+	{"p2p_max_partials_per_peer", "interrupted uploads kept for a single peer, 0 for the peers file's"},
+	{"p2p_max_partial_bytes_per_peer", "bytes of interrupted uploads kept for a single peer, 0 for the peers file's"},
+}
+
+var (
+	// Settings in effect
+	config = defaultConfig()
+
+	// Config file in use, kept private from HTTP
+	configPath = DefaultConfigFile
+)
+
+// Settings in effect, loaded by LoadConfig
+func Settings() *Config {
+	return config
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		HTTPPort:          "8081",
+		P2PPort:           "8080",
+		DataDir:           UploadDirBase,
+		OwnersDir:         OwnersDir,
+		MetadataDir:       MetadataDir,
+		SearchDir:         DefaultSearchDir,
+		PartialDir:        DefaultPartialDir,
+		TLSDir:            DefaultTLSDir,
+		PeersFile:         DefaultPeersFile,
+		SyncStateFile:     DefaultSyncStateFile,
+		KnownPeersFile:    DefaultKnownPeersFile,
+		BufferSize:        32 * 1024, // 32KB per buffer
+		BlockedExtensions: []string{"php", "phtml", "php3", "php4", "php5", "php7", "phps", "pht", "phar"},
+		BlockedTypes:      []string{"application/x-httpd-php"},
+	}
+}
+
+// Load the settings from the config file, the environment and the given
+// command-line arguments, then check them. The setting flags are added to
+// the command's own flags, and its arguments are left in flags.Args().
+func LoadConfig(flags *flag.FlagSet, args []string) error {
+	flagConfig := flags.String("config", "", "settings file (default "+DefaultConfigFile+")")
+	for _, setting := range configSettings {
+		flags.String(strings.ReplaceAll(setting.key, "_", "-"), "", setting.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// An explicitly chosen file must exist, the default one is optional
+	configPath = DefaultConfigFile
+	explicit := false
+	if envConfig := os.Getenv(ConfigEnvPrefix + "CONFIG"); envConfig != "" {
+		configPath, explicit = envConfig, true
+	}
+	if *flagConfig != "" {
+		configPath, explicit = *flagConfig, true
+	}
+
+	loaded := defaultConfig()
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil && (explicit || !os.IsNotExist(err)) {
+		return fmt.Errorf("Error reading %s: %v", configPath, err)
+	}
+	if err == nil {
+		// Misspelled settings are errors rather than silently ignored
+		decoder := json.NewDecoder(bytes.NewReader(configBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(loaded); err != nil {
+			return fmt.Errorf("Error parsing %s: %v", configPath, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		envName := ConfigEnvPrefix + strings.ToUpper(setting.key)
+		if value, found := os.LookupEnv(envName); found {
+			if err := loaded.set(setting.key, value); err != nil {
+				return fmt.Errorf("Invalid %s: %v", envName, err)
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		key := strings.ReplaceAll(f.Name, "-", "_")
+		if !isConfigSetting(key) || flagErr != nil {
+			return
+		}
+		if err := loaded.set(key, f.Value.String()); err != nil {
+			flagErr = fmt.Errorf("Invalid -%s: %v", f.Name, err)
+		}
+	})
+	if flagErr != nil {
+		return flagErr
+	}
+
+	if err := loaded.validate(); err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+	config = loaded
+	return nil
+}
+
+// Check whether a key names a setting
+func isConfigSetting(key string) bool {
+	for _, setting := range configSettings {
+		if setting.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Set a setting from its text form
+func (c *Config) set(key string, value string) error {
+	switch key {
+	case "http_port":
+		c.HTTPPort = value
+	case "p2p_port":
+		c.P2PPort = value
+	case "data_dir":
+		c.DataDir = value
+	case "owners_dir":
+		c.OwnersDir = value
+	case "metadata_dir":
+		c.MetadataDir = value
+	case "buffer_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		c.BufferSize = size
+	case "blocked_extensions":
+		c.BlockedExtensions = splitList(value)
+	case "allowed_extensions":
+		c.AllowedExtensions = splitList(value)
+	case "allowed_types":
+		c.AllowedTypes = splitList(value)
+	case "blocked_types":
+		c.BlockedTypes = splitList(value)
+	case "sandbox_port":
+		c.SandboxPort = value
+	case "sandbox_url":
+		c.SandboxURL = value
+	case "search_dir":
+		c.SearchDir = value
+	case "partial_dir":
+		c.PartialDir = value
+	case "tls_dir":
+		c.TLSDir = value
+	case "peers_file":
+		c.PeersFile = value
+	case "sync_state_file":
+		c.SyncStateFile = value
+	case "known_peers_file":
+		c.KnownPeersFile = value
+	case "p2p_read_timeout":
+		c.P2PReadTimeout = value
+	case "p2p_write_timeout":
+		c.P2PWriteTimeout = value
+	case "p2p_max_path_length", "p2p_max_connections", "p2p_max_connections_per_ip", "p2p_max_partials", "p2p_max_partials_per_peer":
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "p2p_max_path_length":
+			c.P2PMaxPathLength = limit
+		case "p2p_max_connections":
+			c.P2PMaxConnections = limit
+		case "p2p_max_partials":
+			c.P2PMaxPartials = limit
+		case "p2p_max_partials_per_peer":
+			c.P2PMaxPartialsPerPeer = limit
+		default:
+			c.P2PMaxConnectionsPerIP = limit
+		}
+	case "p2p_max_file_size", "p2p_max_partial_bytes", "p2p_max_partial_bytes_per_peer":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "p2p_max_file_size":
+			c.P2PMaxFileSize = size
+		case "p2p_max_partial_bytes":
+			c.P2PMaxPartialBytes = size
+		default:
+			c.P2PMaxPartialBytesPerPeer = size
+		}
+	case "max_upload_size":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		c.MaxUploadSize = size
+	case "category_max_upload_size":
+		c.CategoryMaxUploadSize = make(map[string]int64)
+		for _, limit := range strings.Split(value, ",") {
+			if limit = strings.TrimSpace(limit); limit == "" {
+				continue
+			}
+			i := strings.LastIndex(limit, "=")
+			if i <= 0 {
+				return fmt.Errorf("Expected category=bytes, got %q", limit)
+			}
+			size, err := strconv.ParseInt(limit[i+1:], 10, 64)
+			if err != nil {
+				return err
+			}
+			c.CategoryMaxUploadSize[limit[:i]] = size
+		}
+	default:
+		return fmt.Errorf("Unknown setting %s", key)
+	}
+	return nil
+}
+
+// Check the settings, normalizing the extension list
+func (c *Config) validate() error {
+	for name, port := range map[string]string{"http_port": c.HTTPPort, "p2p_port": c.P2PPort} {
+		number, err := strconv.Atoi(port)
+		if err != nil || number < 1 || number > 65535 {
+			return fmt.Errorf("%s must be a port number, got %q", name, port)
+		}
+	}
+	if c.HTTPPort == c.P2PPort {
+		return fmt.Errorf("http_port and p2p_port must differ")
+	}
+	if c.SandboxPort != "" {
+		number, err := strconv.Atoi(c.SandboxPort)
+		if err != nil || number < 1 || number > 65535 {
+			return fmt.Errorf("sandbox_port must be a port number, got %q", c.SandboxPort)
+		}
+		if c.SandboxPort == c.HTTPPort || c.SandboxPort == c.P2PPort {
+			return fmt.Errorf("sandbox_port must differ from http_port and p2p_port")
+		}
+	}
+	if c.SandboxURL != "" {
+		parsed, err := url.Parse(c.SandboxURL)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("sandbox_url must be an http or https address, got %q", c.SandboxURL)
+		}
+		if c.SandboxPort == "" {
+			return fmt.Errorf("sandbox_url needs sandbox_port")
+		}
+		c.SandboxURL = strings.TrimSuffix(c.SandboxURL, "/")
+	}
+
+	storeDirs := map[string]string{"data_dir": c.DataDir, "owners_dir": c.OwnersDir, "metadata_dir": c.MetadataDir}
+	stateDirs := map[string]string{"search_dir": c.SearchDir, "partial_dir": c.PartialDir, "tls_dir": c.TLSDir}
+	stateFiles := map[string]string{"peers_file": c.PeersFile, "sync_state_file": c.SyncStateFile, "known_peers_file": c.KnownPeersFile}
+	seen := make(map[string]string)
+	for _, paths := range []map[string]string{storeDirs, stateDirs, stateFiles} {
+		for name, dir := range paths {
+			if strings.TrimSpace(dir) == "" {
+				return fmt.Errorf("%s can't be empty", name)
+			}
+			cleaned := filepath.Clean(dir)
+			if other, found := seen[cleaned]; found {
+				return fmt.Errorf("%s and %s can't be the same path", name, other)
+			}
+			seen[cleaned] = name
+		}
+	}
+	// The store is served to peers and over HTTP, so node state can't be
+	// kept inside it
+	for _, paths := range []map[string]string{stateDirs, stateFiles} {
+		for name, statePath := range paths {
+			for storeName, storeDir := range storeDirs {
+				if isWithinDir(statePath, storeDir) {
+					return fmt.Errorf("%s can't be inside %s", name, storeName)
+				}
+			}
+		}
+	}
+
+	for name, setting := range map[string]string{"p2p_read_timeout": c.P2PReadTimeout, "p2p_write_timeout": c.P2PWriteTimeout} {
+		if setting == "" {
+			continue
+		}
+		if timeout, err := time.ParseDuration(setting); err != nil || timeout <= 0 {
+			return fmt.Errorf("%s must be a duration such as 2m, got %q", name, setting)
+		}
+	}
+	p2pLimits := map[string]int64{
+		"p2p_max_path_length":        int64(c.P2PMaxPathLength),
+		"p2p_max_file_size":          c.P2PMaxFileSize,
+		"p2p_max_connections":        int64(c.P2PMaxConnections),
+		"p2p_max_connections_per_ip": int64(c.P2PMaxConnectionsPerIP),
+
+		"p2p_max_partials":               int64(c.P2PMaxPartials),
+		"p2p_max_partial_bytes":          c.P2PMaxPartialBytes,
+		"p2p_max_partials_per_peer":      int64(c.P2PMaxPartialsPerPeer),
+		"p2p_max_partial_bytes_per_peer": c.P2PMaxPartialBytesPerPeer,
+	}
+	for name, limit := range p2pLimits {
+		if limit < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+
+	if c.BufferSize < 1024 || c.BufferSize > MaxFramePayload {
+		return fmt.Errorf("buffer_size must be between 1024 and %d bytes", MaxFramePayload)
+	}
+	if c.MaxUploadSize < 0 {
+		return fmt.Errorf("max_upload_size can't be negative")
+	}
+	categoryLimits := make(map[string]int64)
+	for category, size := range c.CategoryMaxUploadSize {
+		if size < 0 {
+			return fmt.Errorf("category_max_upload_size of %q can't be negative", category)
+		}
+		categoryLimits[CheckSHA256(category)] = size
+	}
+	c.CategoryMaxUploadSize = categoryLimits
+
+	for _, extensions := range [][]string{c.BlockedExtensions, c.AllowedExtensions} {
+		for i, extension := range extensions {
+			extensions[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(extension), "."))
+		}
+	}
+	for name, types := range map[string][]string{"allowed_types": c.AllowedTypes, "blocked_types": c.BlockedTypes} {
+		for i, contentType := range types {
+			types[i] = strings.ToLower(strings.TrimSpace(contentType))
+			if !strings.Contains(types[i], "/") {
+				return fmt.Errorf("%s must list MIME types such as image/png or image/*, got %q", name, contentType)
+			}
+		}
+	}
+	return nil
+}
+
+// Check whether a path is a directory or lies inside it
+func isWithinDir(filePath string, dir string) bool {
+	relative, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(filePath))
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// Split a comma separated setting, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Check whether uploads with an extension are refused
+func isBlockedExtension(fileExtension string) bool {
+	fileExtension = strings.ToLower(fileExtension)
+	for _, blocked := range config.BlockedExtensions {
+		if fileExtension == blocked {
+			return true
+		}
+	}
+	return false
+}
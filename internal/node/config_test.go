@@ -0,0 +1,113 @@
+package node
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Load the settings with a config file holding the given JSON, keeping
+// the ones in effect for the other tests
+func loadTestConfig(t *testing.T, configJSON string, args ...string) error {
+	previous, previousPath := config, configPath
+	t.Cleanup(func() { config, configPath = previous, previousPath })
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configFile, []byte(configJSON), 0666); err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	return LoadConfig(flags, append([]string{"-config", configFile}, args...))
+}
+
+// The config file is overridden by the environment, and both by flags
+func TestLoadConfigPrecedence(t *testing.T) {
+	t.Setenv(ConfigEnvPrefix+"HTTP_PORT", "9001")
+	t.Setenv(ConfigEnvPrefix+"P2P_PORT", "9100")
+	configJSON := `{
+		"http_port": "9000",
+		"max_upload_size": 100,
+		"blocked_extensions": [".PHP", " exe "],
+		"category_max_upload_size": {"docs": 10}
+	}`
+	if err := loadTestConfig(t, configJSON, "-http-port", "9002"); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.HTTPPort != "9002" || config.P2PPort != "9100" || config.MaxUploadSize != 100 {
+		t.Errorf("ports %s and %s, max upload %d, want 9002, 9100 and 100", config.HTTPPort, config.P2PPort, config.MaxUploadSize)
+	}
+	if strings.Join(config.BlockedExtensions, ",") != "php,exe" {
+		t.Errorf("blocked extensions = %q, want php and exe", config.BlockedExtensions)
+	}
+	if limit, found := config.CategoryMaxUploadSize[CheckSHA256("docs")]; !found || limit != 10 {
+		t.Errorf("category limits = %v, want 10 bytes under the hash of docs", config.CategoryMaxUploadSize)
+	}
+}
+
+// Invalid settings are refused, leaving the ones in effect
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		configJSON string
+		args       []string
+		env        string
+		message    string
+	}{
+		{"unknown setting", `{"htp_port": "9000"}`, nil, "", "htp_port"},
+		{"invalid JSON", `{"http_port": }`, nil, "", "Error parsing"},
+		{"port", `{"http_port": "http"}`, nil, "", "http_port must be a port number"},
+		{"port range", `{}`, []string{"-p2p-port", "70000"}, "", "p2p_port must be a port number"},
+		{"same ports", `{"http_port": "9000", "p2p_port": "9000"}`, nil, "", "must differ"},
+		{"sandbox port", `{"sandbox_port": "8081"}`, nil, "", "sandbox_port must differ"},
+		{"sandbox URL", `{"sandbox_url": "https://sandbox.example"}`, nil, "", "sandbox_url needs sandbox_port"},
+		{"state in the store", `{"partial_dir": "data/partial"}`, nil, "", "partial_dir can't be inside data_dir"},
+		{"shared state file", `{"peers_file": "state.json", "sync_state_file": "state.json"}`, nil, "", "can't be the same path"},
+		{"timeout", `{"p2p_read_timeout": "soon"}`, nil, "", "p2p_read_timeout"},
+		{"negative limit", `{}`, []string{"-p2p-max-file-size", "-1"}, "", "p2p_max_file_size can't be negative"},
+		{"negative partial limit", `{"p2p_max_partials_per_peer": -1}`, nil, "", "p2p_max_partials_per_peer can't be negative"},
+		{"negative upload size", `{"max_upload_size": -1}`, nil, "", "max_upload_size can't be negative"},
+		{"buffer size", `{"buffer_size": 10}`, nil, "", "buffer_size"},
+		{"content type", `{"allowed_types": ["png"]}`, nil, "", "allowed_types"},
+		{"environment", `{}`, nil, "abc", ConfigEnvPrefix + "MAX_UPLOAD_SIZE"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv(ConfigEnvPrefix+"MAX_UPLOAD_SIZE", test.env)
+			}
+			inEffect := config
+			if err := loadTestConfig(t, test.configJSON, test.args...); err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("LoadConfig(%s) = %v, want an error about %s", test.configJSON, err, test.message)
+			}
+			if config != inEffect {
+				t.Errorf("LoadConfig(%s) replaced the settings in effect", test.configJSON)
+			}
+		})
+	}
+}
+
+// A config file given explicitly must exist, the default one may not
+func TestLoadConfigMissingFile(t *testing.T) {
+	previous, previousPath := config, configPath
+	t.Cleanup(func() { config, configPath = previous, previousPath })
+	missing := filepath.Join(t.TempDir(), "missing.json")
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if err := LoadConfig(flags, []string{"-config", missing}); err == nil {
+		t.Error("LoadConfig with a missing -config file succeeded")
+	}
+
+	t.Setenv(ConfigEnvPrefix+"CONFIG", missing)
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if err := LoadConfig(flags, nil); err == nil {
+		t.Errorf("LoadConfig with a missing %sCONFIG file succeeded", ConfigEnvPrefix)
+	}
+}
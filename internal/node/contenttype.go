@@ -0,0 +1,218 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Bytes of content looked at to detect its type, as http.DetectContentType
+const sniffLength = 512
+
+// Signatures of binary formats http.DetectContentType doesn't know
+var magicNumbers = []struct {
+	offset    int
+	signature string
+	mimeType  string
+}{
+	{0, "\x7fELF", "application/x-executable"},
+	{0, "MZ", "application/vnd.microsoft.portable-executable"},
+	{0, "\xca\xfe\xba\xbe", "application/java-vm"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// Extensions stored for each detected type, the canonical one first
+var typeExtensions = []struct {
+	mimeType   string
+	extensions []string
+}{
+	{"text/plain", []string{"txt"}},
+	{"text/html", []string{"html", "htm"}},
+	{"text/xml", []string{"xml"}},
+	{"application/xhtml+xml", []string{"xhtml", "xht"}},
+	{"image/svg+xml", []string{"svg"}},
+	{"text/x-shellscript", []string{"sh"}},
+	{"application/x-httpd-php", []string{"php", "phtml", "php3", "php4", "php5", "php7", "phps", "pht", "phar"}},
+	{"image/png", []string{"png"}},
+	{"image/jpeg", []string{"jpg", "jpeg"}},
+	{"image/gif", []string{"gif"}},
+	{"image/webp", []string{"webp"}},
+	{"image/bmp", []string{"bmp"}},
+	{"image/x-icon", []string{"ico"}},
+	{"image/avif", []string{"avif"}},
+	{"application/pdf", []string{"pdf"}},
+	{"application/postscript", []string{"ps", "eps"}},
+	{"application/zip", []string{"zip", "docx", "xlsx", "pptx", "odt", "ods", "odp", "epub", "jar", "apk"}},
+	{"application/x-gzip", []string{"gz", "tgz"}},
+	{"application/x-rar-compressed", []string{"rar"}},
+	{"application/x-7z-compressed", []string{"7z"}},
+	{"application/x-xz", []string{"xz"}},
+	{"application/x-bzip2", []string{"bz2"}},
+	{"application/x-tar", []string{"tar"}},
+	{"audio/mpeg", []string{"mp3"}},
+	{"audio/wave", []string{"wav"}},
+	{"audio/aiff", []string{"aiff", "aif"}},
+	{"audio/basic", []string{"au", "snd"}},
+	{"audio/midi", []string{"mid", "midi"}},
+	{"application/ogg", []string{"ogg", "oga", "ogv", "opus"}},
+	{"video/mp4", []string{"mp4", "m4v", "m4a"}},
+	{"video/webm", []string{"webm"}},
+	{"video/avi", []string{"avi"}},
+	{"font/woff", []string{"woff"}},
+	{"font/woff2", []string{"woff2"}},
+	{"font/ttf", []string{"ttf"}},
+	{"font/otf", []string{"otf"}},
+	{"application/vnd.ms-fontobject", []string{"eot"}},
+	{"application/wasm", []string{"wasm"}},
+	{"application/vnd.sqlite3", []string{"sqlite", "db"}},
+	{"application/x-executable", []string{"elf"}},
+	{"application/vnd.microsoft.portable-executable", []string{"exe", "dll"}},
+	{"application/java-vm", []string{"class"}},
+	{"application/octet-stream", []string{"bin"}},
+}
+
+// Text formats that are detected as text/plain, so their extension is kept
+var plainTextExtensions = map[string]bool{
+	"txt": true, "text": true, "md": true, "markdown": true, "rst": true, "csv": true, "tsv": true,
+	"log": true, "json": true, "yaml": true, "yml": true, "toml": true, "ini": true, "cfg": true,
+	"conf": true, "srt": true, "vtt": true, "tex": true, "diff": true, "patch": true, "sql": true,
+	"css": true, "js": true, "mjs": true, "ts": true, "go": true, "py": true, "rb": true,
+	"rs": true, "c": true, "h": true, "cpp": true, "hpp": true, "java": true, "kt": true,
+}
+
+// Detect the type of content from its first bytes, without parameters
+func detectContentType(head []byte) string {
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+	detected := http.DetectContentType(head)
+	if i := strings.Index(detected, ";"); i >= 0 {
+		detected = detected[:i]
+	}
+
+	switch detected {
+	case "application/octet-stream":
+		for _, magic := range magicNumbers {
+			if len(head) > magic.offset && bytes.HasPrefix(head[magic.offset:], []byte(magic.signature)) {
+				return magic.mimeType
+			}
+		}
+	case "text/plain", "text/html", "text/xml":
+		// Markup and scripts http.DetectContentType reports as text
+		lower := bytes.ToLower(head)
+		switch {
+		case bytes.Contains(lower, []byte("<?php")) || bytes.HasPrefix(bytes.TrimSpace(lower), []byte("<?=")):
+			return "application/x-httpd-php"
+		case bytes.HasPrefix(head, []byte("#!")):
+			return "text/x-shellscript"
+		case detected != "text/html" && bytes.Contains(lower, []byte("<svg")):
+			return "image/svg+xml"
+		}
+	}
+	return detected
+}
+
+// Type of the content an extension names, "" when unknown
+func extensionType(fileExtension string) string {
+	for _, entry := range typeExtensions {
+		for _, extension := range entry.extensions {
+			if extension == fileExtension {
+				return entry.mimeType
+			}
+		}
+	}
+	return ""
+}
+
+// Extension content of a detected type is stored with. The extension given
+// is kept when it names that type, when it names a text format of text
+// content, so text is never made active, or when it is unknown for content
+// of unknown type. Otherwise the canonical extension of the type is used.
+func contentExtension(fileExtension string, contentType string) string {
+	fileExtension = strings.ToLower(fileExtension)
+	if fileExtension != "" {
+		namedType := extensionType(fileExtension)
+		switch {
+		case namedType == contentType:
+			return fileExtension
+		case strings.HasPrefix(contentType, "text/") && plainTextExtensions[fileExtension]:
+			return fileExtension
+		case contentType == "application/octet-stream" && namedType == "" && isSafeExtension(fileExtension):
+			return fileExtension
+		}
+	}
+
+	for _, entry := range typeExtensions {
+		if entry.mimeType == contentType {
+			return entry.extensions[0]
+		}
+	}
+	return "bin"
+}
+
+// Check that an extension can be used in a file name as is
+func isSafeExtension(fileExtension string) bool {
+	if len(fileExtension) > 16 {
+		return false
+	}
+	for _, c := range fileExtension {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether a MIME type matches a pattern such as image/png or image/*
+func matchesType(contentType string, pattern string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))
+	}
+	matched, _ := path.Match(pattern, contentType)
+	return matched
+}
+
+// Check whether a MIME type matches any pattern of a list
+func matchesAnyType(contentType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesType(contentType, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether an extension is in a list
+func containsExtension(extensions []string, fileExtension string) bool {
+	for _, extension := range extensions {
+		if extension == fileExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the allow and deny lists to an upload. Both the extension it was
+// sent with and the one it would be stored with are checked, so renaming
+// content doesn't get it past the lists.
+func checkContentPolicy(sentExtension string, fileExtension string, contentType string) error {
+	for _, extension := range []string{strings.ToLower(sentExtension), fileExtension} {
+		if extension == "" {
+			continue
+		}
+		if isBlockedExtension(extension) || (len(config.AllowedExtensions) > 0 && !containsExtension(config.AllowedExtensions, extension)) {
+			return &UploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("Error: %s files are not allowed!", strings.ToUpper(extension))}
+		}
+	}
+
+	if matchesAnyType(contentType, config.BlockedTypes) || (len(config.AllowedTypes) > 0 && !matchesAnyType(contentType, config.AllowedTypes)) {
+		return &UploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("Error: %s content is not allowed!", contentType)}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer discovery settings
+const (
+	// Peers learned through gossip and LAN discovery, unless configured
+	DefaultKnownPeersFile = "known_peers.json"
+
+	// Exchange known peers with the session peer
+	CmdPeers = byte(11)
+
+	// Peers kept, and sent in a single exchange
+	MaxKnownPeers  = 256
+	MaxGossipPeers = 64
+
+	// Peers nobody has heard of for this long are forgotten
+	KnownPeerMaxAge = 7 * 24 * time.Hour
+
+	// Where LAN announcements are sent, and how often
+	DefaultDiscoveryAddress = "239.255.80.80:8079"
+	DiscoveryInterval       = 30 * time.Second
+
+	// Marks LAN announcements from this application
+	discoveryMagic = "P2PD"
+)
+
+// Peer learned from another node or from the LAN
+type KnownPeer struct {
+	Address  string    `json:"address"`
+	NodeID   string    `json:"node_id"`
+	Name     string    `json:"name,omitempty"` // Pre-shared key identity the node claims
+	TLS      bool      `json:"tls,omitempty"`
+	Source   string    `json:"source,omitempty"`  // "gossip" or "lan"
+	Relayed  bool      `json:"relayed,omitempty"` // Heard of from another node rather than from the node itself
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Payload of CmdPeers requests and responses
+type PeerExchange struct {
+	NodeID  string      `json:"node_id"`
+	Name    string      `json:"name,omitempty"`    // Pre-shared key identity of the sender
+	Port    string      `json:"port,omitempty"`    // P2P port of the sender
+	Address string      `json:"address,omitempty"` // Address the sender advertises instead of its IP and port
+	TLS     bool        `json:"tls,omitempty"`     // The sender serves TLS
+	Peers   []KnownPeer `json:"peers"`
+}
+
+// LAN discovery datagram
+type discoveryAnnouncement struct {
+	Magic  string `json:"magic"`
+	NodeID string `json:"node_id"`
+	Name   string `json:"name,omitempty"`
+	Port   string `json:"port"`
+	TLS    bool   `json:"tls,omitempty"`
+}
+
+// Peers learned so far, by node ID
+type KnownPeers struct {
+	mutex sync.Mutex
+	peers map[string]*KnownPeer
+}
+
+// Peers used by the scheduler and answered to CmdPeers
+var knownPeers = &KnownPeers{peers: make(map[string]*KnownPeer)}
+
+// Returned when the peer being synced turns out to be this node
+var errPeerIsSelf = fmt.Errorf("Peer is this node")
+
+var (
+	nodeID     string
+	nodeIDOnce sync.Once
+)
+
+// Identity of this node in peer exchanges: its certificate fingerprint, or
+// a random ID when it has no certificate
+func localNodeID() string {
+	nodeIDOnce.Do(func() {
+		nodeID = p2pFingerprint
+		if nodeID == "" {
+			randomID := make([]byte, 32)
+			rand.Read(randomID)
+			nodeID = hex.EncodeToString(randomID)
+		}
+	})
+	return nodeID
+}
+
+// Load the saved peers, dropping the ones not heard of in a long time
+func (kp *KnownPeers) Load() error {
+	peersBytes, err := ioutil.ReadFile(config.KnownPeersFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var peers []KnownPeer
+	if err := json.Unmarshal(peersBytes, &peers); err != nil {
+		return err
+	}
+
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+
+	for i := range peers {
+		if peers[i].NodeID != "" && time.Since(peers[i].LastSeen) < KnownPeerMaxAge {
+			kp.peers[peers[i].NodeID] = &peers[i]
+		}
+	}
+	return nil
+}
+
+// Peers sorted by most recently seen. Must be called with the mutex held.
+func (kp *KnownPeers) sorted() []KnownPeer {
+	peers := make([]KnownPeer, 0, len(kp.peers))
+	for _, peer := range kp.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+	return peers
+}
+
+// Up to max peers seen lately, most recent first
+func (kp *KnownPeers) List(max int) []KnownPeer {
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+
+	var peers []KnownPeer
+	for _, peer := range kp.sorted() {
+		if time.Since(peer.LastSeen) < KnownPeerMaxAge {
+			peers = append(peers, peer)
+		}
+	}
+	return truncatePeers(peers, max)
+}
+
+func truncatePeers(peers []KnownPeer, max int) []KnownPeer {
+	if len(peers) > max {
+		return peers[:max]
+	}
+	return peers
+}
+
+// Add or refresh peers. A node keeps the address it was seen at most
+// recently, but what other nodes relay never replaces what a node said
+// itself. When full, relayed peers are dropped first, then the least
+// recently seen.
+func (kp *KnownPeers) Merge(source string, peers ...KnownPeer) {
+	now := time.Now()
+
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+
+	changed := false
+	for _, peer := range peers {
+		peer := peer
+		if peer.NodeID == "" || peer.NodeID == localNodeID() || !isValidPeerAddress(peer.Address) {
+			continue
+		}
+		// Nodes can't claim to have been seen in the future
+		if peer.LastSeen.After(now) {
+			peer.LastSeen = now
+		}
+		if time.Since(peer.LastSeen) >= KnownPeerMaxAge {
+			continue
+		}
+
+		existing, found := kp.peers[peer.NodeID]
+		if found && (!peer.LastSeen.After(existing.LastSeen) || peer.Relayed && !existing.Relayed) {
+			continue
+		}
+		if !found {
+			log.Printf("Discovered peer %s via %s", peer.Address, source)
+		}
+		peer.Source = source
+		kp.peers[peer.NodeID] = &peer
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	if len(kp.peers) > MaxKnownPeers {
+		peers := kp.sorted()
+		sort.SliceStable(peers, func(i, j int) bool {
+			return !peers[i].Relayed && peers[j].Relayed
+		})
+		for _, stale := range peers[MaxKnownPeers:] {
+			delete(kp.peers, stale.NodeID)
+		}
+	}
+	if err := writeJSONFile(config.KnownPeersFile, kp.sorted()); err != nil {
+		log.Printf("Error saving known peers: %v", err)
+	}
+}
+
+// Check that an address gossiped by a peer looks like host:port
+func isValidPeerAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || len(address) > 255 {
+		return false
+	}
+	portNumber, err := net.LookupPort("tcp", port)
+	return err == nil && portNumber > 0
+}
+
+// What this node tells others about itself and its peers
+func localPeerExchange() PeerExchange {
+	return PeerExchange{
+		NodeID:  localNodeID(),
+		Name:    peersConfig.Name,
+		Port:    config.P2PPort,
+		Address: peersConfig.AdvertiseAddress,
+		TLS:     peersConfig.TLS,
+		Peers:   knownPeers.List(MaxGossipPeers),
+	}
+}
+
+// Learn a node reachable at address and, when the node is authenticated,
+// the peers it relays. Anybody can claim anything in an exchange, so the
+// peers learned are only synced once the peers file or the discovery key
+// can authenticate them.
+func mergePeerExchange(exchange PeerExchange, address string, authenticated bool) {
+	var peers []KnownPeer
+	if authenticated {
+		for _, peer := range truncatePeers(exchange.Peers, MaxGossipPeers) {
+			peer.Relayed = true
+			peers = append(peers, peer)
+		}
+	}
+	if address != "" {
+		peers = append(peers, KnownPeer{Address: address, NodeID: exchange.NodeID, Name: exchange.Name, TLS: exchange.TLS, LastSeen: time.Now()})
+	}
+	knownPeers.Merge("gossip", peers...)
+}
+
+// Address of a node that sent an exchange. Only authenticated nodes may
+// advertise another address than the IP they connected from.
+func exchangeAddress(exchange PeerExchange, remoteAddr net.Addr, authenticated bool) string {
+	if exchange.Address != "" && authenticated {
+		return exchange.Address
+	}
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil || exchange.Port == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, exchange.Port)
+}
+
+// Settings to sync a discovered node with, from the peers file entry able
+// to authenticate it by certificate fingerprint or pre-shared key. Entries
+// with an address are synced there already. Other nodes are authenticated
+// by the discovery key when the network shares one.
+func discoveredPeer(knownPeer KnownPeer) (Peer, bool) {
+	for _, peer := range peersConfig.Peers {
+		if peer.Address != "" {
+			continue
+		}
+		byFingerprint := peer.Fingerprint != "" && peer.Fingerprint == knownPeer.NodeID
+		byName := peer.PSK != "" && peer.Name != "" && peer.Name == knownPeer.Name
+		if byFingerprint || byName {
+			peer.Address = knownPeer.Address
+			// What the node claims may turn TLS on, never off
+			peer.TLS = peer.TLS || peer.Fingerprint != "" || knownPeer.TLS
+			return peer, true
+		}
+	}
+	if peersConfig.DiscoveryPSK != "" {
+		return Peer{Address: knownPeer.Address, TLS: knownPeer.TLS, PSK: peersConfig.DiscoveryPSK}, true
+	}
+	return Peer{}, false
+}
+
+// Answer a CmdPeers request. peerName is set when the session peer is
+// authenticated.
+func handlePeerExchange(writer *frameWriter, f frame, remoteAddr net.Addr, peerName string) {
+	if !peersConfig.Gossip {
+		writer.sendError(f.requestID, "Peer exchange disabled")
+		return
+	}
+
+	var exchange PeerExchange
+	if err := json.Unmarshal(f.payload, &exchange); err != nil {
+		writer.sendError(f.requestID, "Invalid peer exchange")
+		return
+	}
+	authenticated := peerName != ""
+	mergePeerExchange(exchange, exchangeAddress(exchange, remoteAddr, authenticated), authenticated)
+	writer.sendJSON(CmdSuccess, f.requestID, localPeerExchange())
+}
+
+// Trade known peers with the session peer
+func (s *Session) ExchangePeers(local PeerExchange) (PeerExchange, error) {
+	payload, _ := json.Marshal(local)
+	response, err := s.call(CmdPeers, payload)
+	if err != nil {
+		return PeerExchange{}, fmt.Errorf("Error exchanging peers: %v", err)
+	}
+
+	var remote PeerExchange
+	if err := json.Unmarshal(response, &remote); err != nil {
+		return PeerExchange{}, fmt.Errorf("Error decoding peers: %v", err)
+	}
+	return remote, nil
+}
+
+// Gossip with a peer being synced: the peer is remembered at the address it
+// was reached at, along with the peers it knows when it was authenticated
+func gossipWithPeer(session *Session, peer Peer) error {
+	remote, err := session.ExchangePeers(localPeerExchange())
+	if err != nil {
+		return err
+	}
+	if remote.NodeID == localNodeID() {
+		return errPeerIsSelf
+	}
+
+	remote.TLS = peer.TLS
+	mergePeerExchange(remote, peer.Address, peer.Fingerprint != "" || peer.PSK != "")
+	return nil
+}
+
+// Announce this node on the LAN and learn the nodes announcing themselves,
+// over multicast or broadcast depending on the discovery address
+func runLANDiscovery() {
+	address := peersConfig.DiscoveryAddress
+	if address == "" {
+		address = DefaultDiscoveryAddress
+	}
+	groupAddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		log.Printf("Error starting LAN discovery: %v", err)
+		return
+	}
+
+	var listener *net.UDPConn
+	if groupAddr.IP.IsMulticast() {
+		listener, err = net.ListenMulticastUDP("udp4", nil, groupAddr)
+	} else {
+		listener, err = net.ListenUDP("udp4", &net.UDPAddr{Port: groupAddr.Port})
+	}
+	if err != nil {
+		log.Printf("Error starting LAN discovery: %v", err)
+		return
+	}
+	defer listener.Close()
+	log.Printf("LAN discovery on %s", address)
+
+	go announceOnLAN(groupAddr)
+
+	buffer := make([]byte, 1024)
+	for {
+		n, source, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			log.Printf("Error reading LAN announcement: %v", err)
+			return
+		}
+
+		var announcement discoveryAnnouncement
+		if json.Unmarshal(buffer[:n], &announcement) != nil || announcement.Magic != discoveryMagic {
+			continue
+		}
+		knownPeers.Merge("lan", KnownPeer{
+			Address:  net.JoinHostPort(source.IP.String(), announcement.Port),
+			NodeID:   announcement.NodeID,
+			Name:     announcement.Name,
+			TLS:      announcement.TLS,
+			LastSeen: time.Now(),
+		})
+	}
+}
+
+// Send an announcement every DiscoveryInterval
+func announceOnLAN(groupAddr *net.UDPAddr) {
+	conn, err := net.DialUDP("udp4", nil, groupAddr)
+	if err != nil {
+		log.Printf("Error starting LAN announcements: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	announcement, _ := json.Marshal(discoveryAnnouncement{
+		Magic:  discoveryMagic,
+		NodeID: localNodeID(),
+		Name:   peersConfig.Name,
+		Port:   config.P2PPort,
+		TLS:    peersConfig.TLS,
+	})
+
+	ticker := time.NewTicker(DiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.Write(announcement); err != nil {
+			log.Printf("Error sending LAN announcement: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,410 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest name an entry received from a peer may have
+const maxIndexNameLength = 1024
+
+// Entry of a category or content folder index
+type IndexEntry struct {
+	FileHash  string    `json:"file_hash"`
+	Extension string    `json:"extension"`
+	Name      string    `json:"name"`
+	Time      time.Time `json:"time"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
+
+	// Type detected from the content on upload
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Index of a data/<hash> folder, kept in index.json and rendered to index.html
+type Index struct {
+	Hash    string       `json:"hash"`
+	Entries []IndexEntry `json:"entries"`
+}
+
+// File name of the indexed content
+func (e IndexEntry) FileName() string {
+	return e.FileHash + "." + e.Extension
+}
+
+// Page rendered from an index. Links to content in the folder's own hash are
+// relative to the folder, the rest go through the sibling content folder.
+var indexTemplate = template.Must(template.New("index").Parse(
+	`<link rel='stylesheet' href='../../default.css'><script src='../../default.js'></script><script src='../../ads.js'></script><div id='ads' name='ads' class='ads'></div><div id='default' name='default' class='default'></div>` +
+		`{{range .Entries}}<a href="../../?reply={{.FileHash}}">[ Reply ]</a> <a href="../{{.FileHash}}/index.html">[ Open ]</a> <a href="../../thread/{{.FileHash}}">[ Thread ]</a> ` +
+		`<a href="{{if eq .FileHash $.Hash}}{{.FileName}}{{else}}../{{.FileHash}}/{{.FileName}}{{end}}">{{.Name}}</a><br>{{end}}`))
+
+// Links written to index pages, used to read pages that have no index.json
+// Names of text uploads may span lines. Only pages rendered from an index
+// have the thread link.
+var legacyIndexLink = regexp.MustCompile(`(?s)<a href="\.\./\.\./\?reply=([a-fA-F0-9]{64})">\[ Reply \]</a> <a href="\.\./[a-fA-F0-9]{64}/index\.html">\[ Open \]</a> (<a href="[^"]*">\[ Thread \]</a> )?<a href="([^"]*)">(.*?)</a><br>`)
+
+// Paths of a folder's index files
+func indexJSONPath(hash string) string {
+	return path.Join(UploadDirBase, hash, "index.json")
+}
+
+func indexHTMLPath(hash string) string {
+	return path.Join(UploadDirBase, hash, "index.html")
+}
+
+// Copy of a legacy page kept before it is replaced. Hidden, so it is
+// neither served nor synced.
+func indexBackupPath(hash string) string {
+	return path.Join(UploadDirBase, hash, ".index.html.bak")
+}
+
+// Load the index of a folder, reading a legacy index.html when there is no
+// index.json yet. A legacy page may be backed up, so the caller holds the
+// index lock; read paths use readIndex.
+func loadIndex(hash string) (*Index, error) {
+	index, legacyPage, err := readIndex(hash)
+	if err != nil || legacyPage == nil {
+		return index, err
+	}
+
+	// The page is replaced by one rendered from the entries read, so keep
+	// it when some of its links couldn't be read
+	if links := legacyLinks(legacyPage); len(index.Entries) < links {
+		if err := backupIndexPage(hash, legacyPage); err != nil {
+			return nil, err
+		}
+		log.Printf("Read %d of %d entries of %s, kept it in %s", len(index.Entries), links, indexHTMLPath(hash), indexBackupPath(hash))
+	}
+	return index, nil
+}
+
+// Read the index of a folder without changing anything. The legacy page
+// is returned when the entries were read from one.
+func readIndex(hash string) (*Index, []byte, error) {
+	index := &Index{Hash: hash, Entries: []IndexEntry{}}
+
+	indexBytes, err := store.ReadFile(indexJSONPath(hash))
+	if err == nil {
+		if err := json.Unmarshal(indexBytes, index); err != nil {
+			return nil, nil, err
+		}
+		return index, nil, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	pageBytes, err := store.ReadFile(indexHTMLPath(hash))
+	if err != nil {
+		return index, nil, nil
+	}
+	index.Entries = parseLegacyIndex(string(pageBytes))
+	return index, pageBytes, nil
+}
+
+// Number of entries a legacy page links to
+func legacyLinks(page []byte) int {
+	return strings.Count(string(page), "[ Reply ]")
+}
+
+// Keep a copy of an index page, unless one is already kept
+func backupIndexPage(hash string, page []byte) error {
+	if _, err := store.Stat(indexBackupPath(hash)); err == nil {
+		return nil
+	}
+	if err := store.WriteFile(indexBackupPath(hash), page); err != nil {
+		return fmt.Errorf("Error keeping a copy of %s: %v", indexHTMLPath(hash), err)
+	}
+	return nil
+}
+
+// Extract entries from an old index.html. Legacy pages wrote names as they
+// were uploaded, so only names of pages rendered from an index are
+// unescaped.
+func parseLegacyIndex(page string) []IndexEntry {
+	entries := []IndexEntry{}
+
+	for _, match := range legacyIndexLink.FindAllStringSubmatch(page, -1) {
+		fileHash := match[1]
+		rendered := match[2] != ""
+		fileName := path.Base(match[3])
+		if !strings.HasPrefix(fileName, fileHash+".") {
+			continue
+		}
+
+		name := match[4]
+		if rendered {
+			name = html.UnescapeString(name)
+		}
+		entry := IndexEntry{
+			FileHash:  fileHash,
+			Extension: strings.TrimPrefix(fileName, fileHash+"."),
+			Name:      name,
+		}
+
+		// Old pages have no timestamps, so fall back to the content's
+		if info, err := store.Stat(blobPath(entry.FileHash, entry.Extension)); err == nil {
+			entry.Time = info.ModTime
+		}
+
+		if !hasIndexEntry(entries, entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Check if an index already lists some content
+func hasIndexEntry(entries []IndexEntry, entry IndexEntry) bool {
+	for _, existing := range entries {
+		if existing.FileHash == entry.FileHash && existing.Extension == entry.Extension {
+			return true
+		}
+	}
+	return false
+}
+
+// Save an index and render its page
+func saveIndex(index *Index) error {
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.WriteFile(indexJSONPath(index.Hash), indexBytes); err != nil {
+		return err
+	}
+
+	var page bytes.Buffer
+	if err := indexTemplate.Execute(&page, index); err != nil {
+		return err
+	}
+	return store.WriteFile(indexHTMLPath(index.Hash), page.Bytes())
+}
+
+// Take the lock serializing updates of a folder index. The lock covers
+// both index.json and index.html, and other processes sharing the store.
+func lockIndex(hash string) (func(), error) {
+	return lockRecord(indexJSONPath(hash))
+}
+
+// Add an entry to a folder index unless it is already listed
+func addIndexEntry(hash string, entry IndexEntry) error {
+	unlock, err := lockIndex(hash)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := loadIndex(hash)
+	if err != nil {
+		return err
+	}
+	if hasIndexEntry(index.Entries, entry) {
+		return nil
+	}
+
+	index.Entries = append(index.Entries, entry)
+	return saveIndex(index)
+}
+
+// Add the entries of a peer's index that aren't listed yet, returning them.
+// Entries are kept in time order so peers with the same entries converge on
+// the same index.json.
+func mergeIndexEntries(hash string, entries []IndexEntry) ([]IndexEntry, error) {
+	unlock, err := lockIndex(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	index, err := loadIndex(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var added []IndexEntry
+	for _, entry := range entries {
+		if !isValidIndexEntry(entry) || hasIndexEntry(index.Entries, entry) {
+			continue
+		}
+		index.Entries = append(index.Entries, entry)
+		added = append(added, entry)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(index.Entries, func(i, j int) bool {
+		return index.Entries[i].Time.Before(index.Entries[j].Time)
+	})
+	return added, saveIndex(index)
+}
+
+// Check the fields of an entry read from a peer before it is listed. The
+// extension ends up in links and file names, so it must be one an upload
+// could have given.
+func isValidIndexEntry(entry IndexEntry) bool {
+	if !IsValidSHA256(entry.FileHash) || !isSafeExtension(entry.Extension) {
+		return false
+	}
+	if entry.ReplyTo != "" && !IsValidSHA256(entry.ReplyTo) {
+		return false
+	}
+	if len(entry.Name) > maxIndexNameLength || strings.ContainsRune(entry.Name, 0) {
+		return false
+	}
+	if entry.ContentType != "" {
+		mediaType, params, err := mime.ParseMediaType(entry.ContentType)
+		if err != nil || len(params) > 0 || mediaType != entry.ContentType {
+			return false
+		}
+	}
+	return true
+}
+
+// Convert every legacy index.html into index.json
+func MigrateIndexes() error {
+	fileList, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, filePath := range fileList {
+		if path.Base(filePath) != "index.html" {
+			continue
+		}
+
+		hash := path.Base(path.Dir(filePath))
+		index, err := migrateIndex(hash)
+		if err != nil {
+			log.Printf("Error migrating index of %s: %v", hash, err)
+			continue
+		}
+		if index == nil {
+			continue // Already migrated
+		}
+
+		log.Printf("Migrated %s (%d entries)", filePath, len(index.Entries))
+		migrated++
+	}
+
+	log.Printf("Migrated %d index pages", migrated)
+	return nil
+}
+
+// Convert a folder's legacy index.html into index.json, returning the
+// index, or nil when the folder already has an index.json
+func migrateIndex(hash string) (*Index, error) {
+	unlock, err := lockIndex(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := store.Stat(indexJSONPath(hash)); err == nil {
+		return nil, nil
+	}
+	index, err := loadIndex(hash)
+	if err != nil {
+		return nil, err
+	}
+	return index, saveIndex(index)
+}
+
+// Render every index page again from its entries, so names old versions
+// wrote into pages unescaped are escaped. Pages without index.json are
+// read as legacy pages and migrated on the way.
+func RepairIndexes(dryRun bool) error {
+	fileList, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	repaired := 0
+	seen := make(map[string]bool)
+	for _, filePath := range fileList {
+		name := path.Base(filePath)
+		if name != "index.html" && name != "index.json" {
+			continue
+		}
+		hash := path.Base(path.Dir(filePath))
+		if seen[hash] || !IsValidSHA256(hash) {
+			continue
+		}
+		seen[hash] = true
+
+		changed, err := repairIndex(hash, dryRun)
+		if err != nil {
+			log.Printf("Error repairing index of %s: %v", hash, err)
+			continue
+		}
+		if changed && dryRun {
+			log.Printf("Would repair %s", indexHTMLPath(hash))
+			repaired++
+		} else if changed {
+			log.Printf("Repaired %s", indexHTMLPath(hash))
+			repaired++
+		}
+	}
+
+	if dryRun {
+		log.Printf("Would repair %d of %d index pages", repaired, len(seen))
+	} else {
+		log.Printf("Repaired %d of %d index pages", repaired, len(seen))
+	}
+	return nil
+}
+
+// Render a folder's index page again, reporting whether it changed. The
+// page replaced is kept in its backup first, unless one is kept already.
+// A dry run only reports, including the entries a legacy page would lose.
+func repairIndex(hash string, dryRun bool) (bool, error) {
+	if !dryRun {
+		unlock, err := lockIndex(hash)
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+	}
+
+	index, legacyPage, err := readIndex(hash)
+	if err != nil {
+		return false, err
+	}
+	var page bytes.Buffer
+	if err := indexTemplate.Execute(&page, index); err != nil {
+		return false, err
+	}
+	oldPage, readErr := store.ReadFile(indexHTMLPath(hash))
+	if readErr == nil && bytes.Equal(oldPage, page.Bytes()) {
+		if _, err := store.Stat(indexJSONPath(hash)); err == nil {
+			return false, nil
+		}
+	}
+
+	if links := legacyLinks(legacyPage); len(index.Entries) < links {
+		log.Printf("Read %d of %d entries of %s", len(index.Entries), links, indexHTMLPath(hash))
+	}
+	if dryRun {
+		return true, nil
+	}
+	if readErr == nil {
+		if err := backupIndexPage(hash, oldPage); err != nil {
+			return false, err
+		}
+	}
+	return true, saveIndex(index)
+}
@@ -0,0 +1,274 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// P2P listener limits used when the peers file doesn't set them
+const (
+	DefaultMaxFileSize         = 4 * 1024 * 1024 * 1024
+	DefaultReadTimeout         = 2 * time.Minute
+	DefaultWriteTimeout        = 2 * time.Minute
+	DefaultMaxConnections      = 64
+	DefaultMaxConnectionsPerIP = 8
+
+	// Partial files peers may leave behind, in total and each
+	DefaultMaxPartials            = 256
+	DefaultMaxPartialBytes        = 16 * 1024 * 1024 * 1024
+	DefaultMaxPartialsPerPeer     = 16
+	DefaultMaxPartialBytesPerPeer = DefaultMaxFileSize
+
+	// Time given to a refused connection to read why, and refused
+	// connections told why at once. The others are closed right away.
+	refusalTimeout     = 10 * time.Second
+	MaxPendingRefusals = 16
+
+	// Time given to a peer being synced to accept the connection, and to
+	// complete the TLS, session and pre-shared key handshakes
+	DialTimeout      = 30 * time.Second
+	HandshakeTimeout = 30 * time.Second
+)
+
+// Limits protecting the P2P listener
+type ListenerLimits struct {
+	MaxPathLength       int
+	MaxFileSize         int64
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// Resumable uploads of peers, counted by their announced size until
+	// they complete
+	MaxPartials            int
+	MaxPartialBytes        int64
+	MaxPartialsPerPeer     int
+	MaxPartialBytesPerPeer int64
+}
+
+// Limits from the configuration, then from the peers file, with defaults
+// for the ones neither sets
+func p2pLimits() ListenerLimits {
+	limits := ListenerLimits{
+		MaxPathLength:       peersConfig.MaxPathLength,
+		MaxFileSize:         peersConfig.MaxFileSize,
+		ReadTimeout:         DefaultReadTimeout,
+		WriteTimeout:        DefaultWriteTimeout,
+		MaxConnections:      peersConfig.MaxConnections,
+		MaxConnectionsPerIP: peersConfig.MaxConnectionsPerIP,
+
+		MaxPartials:            peersConfig.MaxPartials,
+		MaxPartialBytes:        peersConfig.MaxPartialBytes,
+		MaxPartialsPerPeer:     peersConfig.MaxPartialsPerPeer,
+		MaxPartialBytesPerPeer: peersConfig.MaxPartialBytesPerPeer,
+	}
+	if config.P2PMaxPathLength > 0 {
+		limits.MaxPathLength = config.P2PMaxPathLength
+	}
+	if config.P2PMaxFileSize > 0 {
+		limits.MaxFileSize = config.P2PMaxFileSize
+	}
+	if config.P2PMaxConnections > 0 {
+		limits.MaxConnections = config.P2PMaxConnections
+	}
+	if config.P2PMaxConnectionsPerIP > 0 {
+		limits.MaxConnectionsPerIP = config.P2PMaxConnectionsPerIP
+	}
+	if config.P2PMaxPartials > 0 {
+		limits.MaxPartials = config.P2PMaxPartials
+	}
+	if config.P2PMaxPartialBytes > 0 {
+		limits.MaxPartialBytes = config.P2PMaxPartialBytes
+	}
+	if config.P2PMaxPartialsPerPeer > 0 {
+		limits.MaxPartialsPerPeer = config.P2PMaxPartialsPerPeer
+	}
+	if config.P2PMaxPartialBytesPerPeer > 0 {
+		limits.MaxPartialBytesPerPeer = config.P2PMaxPartialBytesPerPeer
+	}
+
+	if limits.MaxPathLength <= 0 {
+		limits.MaxPathLength = MaxPeerPathLength
+	}
+	if limits.MaxFileSize <= 0 {
+		limits.MaxFileSize = DefaultMaxFileSize
+	}
+	for _, setting := range []string{peersConfig.ReadTimeout, config.P2PReadTimeout} {
+		if timeout, err := time.ParseDuration(setting); err == nil && timeout > 0 {
+			limits.ReadTimeout = timeout
+		}
+	}
+	for _, setting := range []string{peersConfig.WriteTimeout, config.P2PWriteTimeout} {
+		if timeout, err := time.ParseDuration(setting); err == nil && timeout > 0 {
+			limits.WriteTimeout = timeout
+		}
+	}
+	if limits.MaxConnections <= 0 {
+		limits.MaxConnections = DefaultMaxConnections
+	}
+	if limits.MaxConnectionsPerIP <= 0 {
+		limits.MaxConnectionsPerIP = DefaultMaxConnectionsPerIP
+	}
+	if limits.MaxPartials <= 0 {
+		limits.MaxPartials = DefaultMaxPartials
+	}
+	if limits.MaxPartialBytes <= 0 {
+		limits.MaxPartialBytes = DefaultMaxPartialBytes
+	}
+	if limits.MaxPartialsPerPeer <= 0 {
+		limits.MaxPartialsPerPeer = DefaultMaxPartialsPerPeer
+	}
+	if limits.MaxPartialBytesPerPeer <= 0 {
+		limits.MaxPartialBytesPerPeer = DefaultMaxPartialBytesPerPeer
+	}
+	return limits
+}
+
+// Check the timeouts of the peers file, so typos don't silently fall back
+// to the defaults
+func checkListenerTimeouts(settings *PeersConfig) error {
+	for name, setting := range map[string]string{"read_timeout": settings.ReadTimeout, "write_timeout": settings.WriteTimeout} {
+		if setting == "" {
+			continue
+		}
+		if timeout, err := time.ParseDuration(setting); err != nil || timeout <= 0 {
+			return fmt.Errorf("Invalid %s in %s: %q", name, config.PeersFile, setting)
+		}
+	}
+	return nil
+}
+
+// Refuse transfers whose path or size exceed the limits
+func checkTransferLimits(filePath string, size int64) error {
+	limits := p2pLimits()
+	if len(filePath) > limits.MaxPathLength {
+		return fmt.Errorf("Path too long")
+	}
+	if size > limits.MaxFileSize {
+		return fmt.Errorf("File too large: %d bytes, the limit is %d", size, limits.MaxFileSize)
+	}
+	return nil
+}
+
+// Connection that must make progress on every read and write. A peer
+// accepting data is alive too, so writes also push back the deadline of
+// the read waiting meanwhile, as while a large file is sent.
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return n, err
+}
+
+// Close a connection when ctx ends or timeout passes, until the returned
+// function is called. That function returns why the connection was closed,
+// or nil when it is still open.
+func closeOnCancel(ctx context.Context, conn net.Conn, timeout time.Duration) func() error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	var mutex sync.Mutex
+	stopped := false
+	go func() {
+		<-ctx.Done()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !stopped {
+			conn.Close()
+		}
+	}()
+
+	return func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		err := ctx.Err()
+		stopped = true
+		cancel()
+		return err
+	}
+}
+
+// Open P2P connections, in total and by IP
+type connectionLimiter struct {
+	mutex sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var p2pConnections = &connectionLimiter{perIP: make(map[string]int)}
+
+// Count a new connection unless a limit is reached. The returned function
+// ends the connection's count.
+func (l *connectionLimiter) acquire(addr net.Addr, limits ListenerLimits) (func(), error) {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.total >= limits.MaxConnections {
+		return nil, fmt.Errorf("Too many connections")
+	}
+	if l.perIP[ip] >= limits.MaxConnectionsPerIP {
+		return nil, fmt.Errorf("Too many connections from %s", ip)
+	}
+	l.total++
+	l.perIP[ip]++
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.total--
+		l.perIP[ip]--
+		if l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+	}, nil
+}
+
+// Refusals being explained
+var p2pRefusals = make(chan struct{}, MaxPendingRefusals)
+
+// Tell a connection over the limits why it is refused, then close it.
+// Plain connections get the reason once their request arrived; TLS ones
+// aren't worth a handshake and are only closed.
+func refuseP2PConnection(rawConn net.Conn, reason string) {
+	log.Printf("Refused P2P connection from %s: %s", rawConn.RemoteAddr(), reason)
+	select {
+	case p2pRefusals <- struct{}{}:
+	default:
+		rawConn.Close()
+		return
+	}
+
+	go func() {
+		defer func() { <-p2pRefusals }()
+		defer rawConn.Close()
+
+		rawConn.SetDeadline(time.Now().Add(refusalTimeout))
+		request := make([]byte, 512)
+		n, err := rawConn.Read(request)
+		if err != nil || n == 0 || request[0] == tlsHandshakeByte {
+			return
+		}
+		writeP2PError(rawConn, reason)
+	}()
+}
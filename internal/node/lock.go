@@ -0,0 +1,62 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Mutexes by key, dropped once nothing holds or waits for them
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// Lock a key, returning the function unlocking it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mutex.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	lock, found := k.locks[key]
+	if !found {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.waiters++
+	k.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		k.mutex.Lock()
+		if lock.waiters--; lock.waiters == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// Locks of the records being updated in this process
+var recordLocks keyedMutex
+
+// Take the lock on a store record for a read-modify-write update. Updates
+// are serialized by record in this process, and through the store with
+// other processes using the same directories.
+func lockRecord(filePath string) (func(), error) {
+	unlock := recordLocks.Lock(filePath)
+	unlockStore, err := store.Lock(filePath)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("Error locking %s: %v", filePath, err)
+	}
+	return func() {
+		unlockStore()
+		unlock()
+	}, nil
+}
@@ -0,0 +1,45 @@
+//go:build !unix && !windows
+
+package node
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// These systems have no file locks to use, so only the goroutines of this
+// process are kept out of a locked file
+const processFileLocks = false
+
+var (
+	// Locks of the files locked in this process, by name
+	fileLocks keyedMutex
+
+	// Unlock functions of the open files holding a lock
+	fileUnlocks      = make(map[*os.File]func())
+	fileUnlocksMutex sync.Mutex
+)
+
+// Wait for an exclusive lock on an open file
+func lockFile(file *os.File) error {
+	unlock := fileLocks.Lock(file.Name())
+	fileUnlocksMutex.Lock()
+	defer fileUnlocksMutex.Unlock()
+	fileUnlocks[file] = unlock
+	return nil
+}
+
+// Release the lock on an open file
+func unlockFile(file *os.File) error {
+	fileUnlocksMutex.Lock()
+	unlock, found := fileUnlocks[file]
+	delete(fileUnlocks, file)
+	fileUnlocksMutex.Unlock()
+
+	if !found {
+		return fmt.Errorf("%s is not locked", file.Name())
+	}
+	unlock()
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package node
+
+import (
+	"os"
+	"syscall"
+)
+
+// File locks exclude other processes
+const processFileLocks = true
+
+// Wait for an exclusive lock on an open file
+func lockFile(file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Release the lock on an open file
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,41 @@
+//go:build windows
+
+package node
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// File locks exclude other processes
+const processFileLocks = true
+
+// LOCKFILE_EXCLUSIVE_LOCK flag of LockFileEx
+const lockfileExclusiveLock = 0x2
+
+// Wait for an exclusive lock on an open file
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	result, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if result == 0 {
+		return err
+	}
+	return nil
+}
+
+// Release the lock on an open file
+func unlockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	result, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if result == 0 {
+		return err
+	}
+	return nil
+}
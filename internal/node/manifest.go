@@ -0,0 +1,114 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stored file as advertised to peers
+type ManifestEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	ModTime int64  `json:"mtime"`
+}
+
+// Hash computed for a file at a given size and modification time
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	sha256  string
+}
+
+// Hashes of files that aren't content blobs, reused while files are unchanged
+var (
+	manifestCache      = make(map[string]cachedHash)
+	manifestCacheMutex sync.Mutex
+)
+
+// Get the hash encoded in a content blob path, data/<hash>/<hash>.<ext>
+func blobHashFromPath(filePath string) (string, bool) {
+	parts := strings.Split(filePath, "/")
+	if len(parts) != 3 || parts[0] != UploadDirBase || !IsValidSHA256(parts[1]) {
+		return "", false
+	}
+	if !strings.HasPrefix(parts[2], parts[1]+".") {
+		return "", false
+	}
+	return strings.ToLower(parts[1]), true
+}
+
+// Calculate the SHA-256 of a stored file
+func hashStoredFile(filePath string) (string, error) {
+	file, err := store.Get(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.CopyBuffer(hasher, file, make([]byte, config.BufferSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Describe a stored file for the manifest
+func manifestEntry(filePath string) (ManifestEntry, error) {
+	info, err := store.Stat(filePath)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	entry := ManifestEntry{
+		Path:    filePath,
+		Size:    info.Size,
+		ModTime: info.ModTime.Unix(),
+	}
+
+	// Blobs are named after their hash, so only other records need hashing
+	if fileHash, ok := blobHashFromPath(filePath); ok {
+		entry.SHA256 = fileHash
+		return entry, nil
+	}
+
+	manifestCacheMutex.Lock()
+	cached, found := manifestCache[filePath]
+	manifestCacheMutex.Unlock()
+	if found && cached.size == info.Size && cached.modTime.Equal(info.ModTime) {
+		entry.SHA256 = cached.sha256
+		return entry, nil
+	}
+
+	if entry.SHA256, err = hashStoredFile(filePath); err != nil {
+		return ManifestEntry{}, err
+	}
+
+	manifestCacheMutex.Lock()
+	manifestCache[filePath] = cachedHash{size: info.Size, modTime: info.ModTime, sha256: entry.SHA256}
+	manifestCacheMutex.Unlock()
+
+	return entry, nil
+}
+
+// Build the manifest of every stored file
+func buildManifest() ([]ManifestEntry, error) {
+	fileList, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make([]ManifestEntry, 0, len(fileList))
+	for _, filePath := range fileList {
+		entry, err := manifestEntry(path.Clean(filePath))
+		if err != nil {
+			continue // Removed while listing
+		}
+		manifest = append(manifest, entry)
+	}
+	return manifest, nil
+}
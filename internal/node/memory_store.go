@@ -0,0 +1,199 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store kept entirely in memory, used for tests
+type MemoryStore struct {
+	mutex sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Create an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{files: make(map[string]memoryFile)}
+}
+
+// Save a file, optionally keeping an existing one
+func (s *MemoryStore) put(filePath string, data []byte, overwrite bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.files[filePath]; exists && !overwrite {
+		return
+	}
+	s.files[filePath] = memoryFile{data: data, modTime: time.Now()}
+}
+
+func (s *MemoryStore) Put(src io.Reader, fileExtension string) (string, int64, error) {
+	var buffer bytes.Buffer
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(&buffer, hasher), src)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error saving content: %v", err)
+	}
+
+	fileHash := hex.EncodeToString(hasher.Sum(nil))
+	s.put(blobPath(fileHash, fileExtension), buffer.Bytes(), true)
+	return fileHash, size, nil
+}
+
+// Content staged in memory
+type stagedMemory struct {
+	*bytes.Reader
+	store *MemoryStore
+	data  []byte
+	hash  string
+}
+
+func (s *MemoryStore) Stage(src io.Reader) (StagedContent, error) {
+	var buffer bytes.Buffer
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(&buffer, hasher), src); err != nil {
+		return nil, err
+	}
+	return &stagedMemory{
+		Reader: bytes.NewReader(buffer.Bytes()),
+		store:  s,
+		data:   buffer.Bytes(),
+		hash:   hex.EncodeToString(hasher.Sum(nil)),
+	}, nil
+}
+
+func (m *stagedMemory) Hash() string { return m.hash }
+func (m *stagedMemory) Size() int64  { return int64(len(m.data)) }
+
+func (m *stagedMemory) Commit(fileExtension string) error {
+	m.store.put(blobPath(m.hash, fileExtension), m.data, true)
+	return nil
+}
+
+func (m *stagedMemory) Remove() {}
+
+func (s *MemoryStore) Get(filePath string) (io.ReadSeekCloser, error) {
+	data, err := s.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+// Wrap a reader so it can be returned from Get
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (s *MemoryStore) Link(categoryHash string, fileNameWithExtension string) error {
+	s.put(path.Join(UploadDirBase, categoryHash, fileNameWithExtension), nil, false)
+	return nil
+}
+
+func (s *MemoryStore) PutMetadata(fileHash string, metadata *Metadata) error {
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.put(path.Join(MetadataDir, fileHash+".json"), metadataBytes, false)
+	return nil
+}
+
+func (s *MemoryStore) PutOwner(fileHash string, btcInfo string) error {
+	s.put(path.Join(OwnersDir, fileHash), []byte(btcInfo), false)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	fileList := make([]string, 0, len(s.files))
+	for filePath := range s.files {
+		fileList = append(fileList, filePath)
+	}
+	sort.Strings(fileList)
+	return fileList, nil
+}
+
+func (s *MemoryStore) ReadDir(dirPath string) ([]string, error) {
+	if err := checkStorePath(dirPath); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var names []string
+	prefix := dirPath + "/"
+	for filePath := range s.files {
+		if strings.HasPrefix(filePath, prefix) && !strings.Contains(filePath[len(prefix):], "/") {
+			names = append(names, filePath[len(prefix):])
+		}
+	}
+	if names == nil {
+		return nil, &os.PathError{Op: "open", Path: dirPath, Err: os.ErrNotExist}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStore) Stat(filePath string) (ObjectInfo, error) {
+	if err := checkStorePath(filePath); err != nil {
+		return ObjectInfo{}, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	file, exists := s.files[filePath]
+	if !exists {
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+	}
+	return ObjectInfo{Path: filePath, Size: int64(len(file.data)), ModTime: file.modTime}, nil
+}
+
+func (s *MemoryStore) ReadFile(filePath string) ([]byte, error) {
+	if err := checkStorePath(filePath); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	file, exists := s.files[filePath]
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: filePath, Err: os.ErrNotExist}
+	}
+	return file.data, nil
+}
+
+func (s *MemoryStore) WriteFile(filePath string, data []byte) error {
+	if err := checkStorePath(filePath); err != nil {
+		return err
+	}
+	s.put(filePath, append([]byte(nil), data...), true)
+	return nil
+}
+
+// No other process shares the store, so there is nothing to lock
+func (s *MemoryStore) Lock(filePath string) (func(), error) {
+	if err := checkStorePath(filePath); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
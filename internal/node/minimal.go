@@ -0,0 +1,175 @@
+package node
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Run the simple upload form of the original FileUploadServer, with no
+// P2P, metadata, search page or API, storing into the same data directory
+// as the full server. The settings are loaded already.
+func ServeMinimal() error {
+	OpenStoreForUpdates()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", minimalHandler)
+	startSandboxServer()
+
+	log.Printf("Minimal server started on port %s", config.HTTPPort)
+	return http.ListenAndServe(":"+config.HTTPPort, mux)
+}
+
+// minimalSearch handles search form submission
+func minimalSearch(w http.ResponseWriter, r *http.Request) {
+	searchInput := strings.TrimSpace(r.URL.Query().Get("search-input"))
+	if searchInput == "" {
+		return
+	}
+
+	// Input may be a hash or the text of a category
+	hash := CheckSHA256(searchInput)
+
+	// Check if the page exists
+	if _, err := store.Stat(indexHTMLPath(hash)); err == nil {
+		// Redirect to the page
+		http.Redirect(w, r, "/"+indexHTMLPath(hash), http.StatusFound)
+		return
+	}
+
+	// File doesn't exist
+	fmt.Fprintf(w, "File don't exists!")
+}
+
+// Handle file upload and form submission, and serve the data directory
+func minimalHandler(w http.ResponseWriter, r *http.Request) {
+	// Stored content and index pages
+	if r.URL.Path != "/" {
+		if !serveStoredFile(w, r, r.URL.Path[1:]) {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	// Handle search query
+	if r.Method == http.MethodGet && r.URL.Query().Get("search-input") != "" {
+		minimalSearch(w, r)
+		return
+	}
+
+	reply := r.URL.Query().Get("reply")
+
+	// Render the HTML form
+	if r.Method != http.MethodPost {
+		renderMinimalPage(w, reply, "")
+		return
+	}
+
+	// Read the form within the size limits
+	file, err := readUploadRequest(w, r, "uploaded_file")
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+	if file != nil {
+		defer file.Remove()
+	}
+
+	// Check if category was provided
+	category := r.FormValue("category")
+	if category == "" {
+		// No further processing if category is missing
+		renderMinimalPage(w, reply, "Please enter a category.")
+		return
+	}
+
+	upload := &UploadRequest{
+		Category:    category,
+		TextContent: r.FormValue("text_content"),
+	}
+
+	// Check if a file was uploaded
+	if file != nil {
+		upload.Content = file
+		upload.Size = file.Size()
+		upload.OriginalFileName = file.FileName
+	}
+
+	if upload.Content == nil && upload.TextContent == "" {
+		renderMinimalPage(w, reply, "Please select a file or enter text content and provide a category.")
+		return
+	}
+
+	uploadResult, err := ProcessUpload(upload)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	// Render success message and form
+	fmt.Fprintf(w, "<p class='success'>Content processed successfully!</p>")
+	fmt.Fprintf(w, "<p>Content saved in: <pre><a href='/%s'>%s</a></pre></p>",
+		template.HTMLEscapeString(uploadResult.CategoryIndex),
+		template.HTMLEscapeString(uploadResult.CategoryIndex))
+
+	renderMinimalPage(w, reply, "")
+}
+
+func renderMinimalPage(w http.ResponseWriter, reply string, errorMsg string) {
+	html := `<!DOCTYPE html>
+<html>
+<head>
+<title>File/Text Upload with Category</title>
+</head>
+<body>
+
+<form method="GET" action="" id="search-form">
+    <input type="text" id="search" name="search-input" placeholder="Enter file hash or category" required>
+    <button type="submit">Search</button>
+</form>
+
+<h2>Upload File</h2>
+
+<form action="/`
+
+	if reply != "" {
+		html += "?reply=" + template.HTMLEscapeString(reply)
+	}
+
+	html += `" method="post" enctype="multipart/form-data">
+    <label for="uploaded_file">Select File:</label>
+    <input type="file" name="uploaded_file" id="uploaded_file"><br><br>
+
+    <label for="text_content">Or enter text content:</label><br>
+    <textarea name="text_content" id="text_content" rows="5" cols="40"></textarea><br><br>
+
+    <label for="category">Category:</label>
+    <input type="text" name="category" id="category" value="`
+
+	if reply != "" {
+		html += template.HTMLEscapeString(reply)
+	}
+
+	html += `" required `
+
+	if reply != "" {
+		html += "readonly"
+	}
+
+	html += `><br><br>
+
+    <input type="submit" value="Upload">
+</form>`
+
+	if errorMsg != "" {
+		html += fmt.Sprintf("<p class='error'>%s</p>", template.HTMLEscapeString(errorMsg))
+	}
+
+	html += `
+</body>
+</html>`
+
+	fmt.Fprint(w, html)
+}
@@ -0,0 +1,220 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable transfer settings
+const (
+	// Directory keeping partially transferred files, named after their
+	// SHA-256, unless configured
+	DefaultPartialDir = "partial"
+
+	// Files from this size on are transferred through partial files
+	ResumableTransferSize = 1024 * 1024
+
+	// Partial files untouched for this long are removed on start
+	PartialMaxAge = 7 * 24 * time.Hour
+)
+
+// Partial files in use by a transfer, and the ones kept for peers
+var (
+	partialsInUse      = make(map[string]bool)
+	partialsInUseMutex sync.Mutex
+
+	partialUploads = make(map[string]partialUpload)
+)
+
+// Partial file of an upload, counted against the limits of the peer that
+// started it until it is completed or removed
+type partialUpload struct {
+	owner string
+	size  int64
+}
+
+func partialPath(sha256 string) string {
+	return filepath.Join(config.PartialDir, strings.ToLower(sha256)+".part")
+}
+
+// Reserve the partial file of a hash, so only one transfer writes to it
+func lockPartial(sha256 string) (func(), error) {
+	partialsInUseMutex.Lock()
+	defer partialsInUseMutex.Unlock()
+
+	if partialsInUse[sha256] {
+		return nil, fmt.Errorf("Transfer of %s already in progress", sha256)
+	}
+	partialsInUse[sha256] = true
+	return func() {
+		partialsInUseMutex.Lock()
+		delete(partialsInUse, sha256)
+		partialsInUseMutex.Unlock()
+	}, nil
+}
+
+// Peer partial uploads are counted against: its name once authenticated
+// by its own key, its IP otherwise
+func partialOwner(peerName string, addr net.Addr) string {
+	if peerName != "" && peerName != discoveryPeerName {
+		return "peer " + peerName
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "address " + host
+}
+
+// Count an upload against the partial limits, refusing it when it goes
+// beyond them. Resuming an upload keeps the peer that started it.
+func reservePartial(sha256 string, owner string, size int64, limits ListenerLimits) error {
+	partialsInUseMutex.Lock()
+	defer partialsInUseMutex.Unlock()
+
+	if upload, found := partialUploads[sha256]; found {
+		owner = upload.owner
+	}
+
+	count, bytes := 1, size
+	ownerCount, ownerBytes := 1, size
+	for hash, upload := range partialUploads {
+		if hash == sha256 {
+			continue
+		}
+		count++
+		bytes += upload.size
+		if upload.owner == owner {
+			ownerCount++
+			ownerBytes += upload.size
+		}
+	}
+
+	switch {
+	case count > limits.MaxPartials || bytes > limits.MaxPartialBytes:
+		return fmt.Errorf("Too many interrupted uploads to accept %s", sha256)
+	case ownerCount > limits.MaxPartialsPerPeer || ownerBytes > limits.MaxPartialBytesPerPeer:
+		return fmt.Errorf("Too many interrupted uploads from this peer to accept %s", sha256)
+	}
+	partialUploads[sha256] = partialUpload{owner: owner, size: size}
+	return nil
+}
+
+// Stop counting a partial file that was removed
+func forgetPartial(sha256 string) {
+	partialsInUseMutex.Lock()
+	delete(partialUploads, sha256)
+	partialsInUseMutex.Unlock()
+}
+
+// Number of bytes received so far for a hash
+func partialSize(sha256 string) int64 {
+	info, err := os.Stat(partialPath(sha256))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Append data to a partial file that must hold exactly offset bytes
+func appendPartial(sha256 string, offset int64, src io.Reader) error {
+	if current := partialSize(sha256); current != offset {
+		return fmt.Errorf("Offset %d doesn't match the %d bytes received so far", offset, current)
+	}
+
+	os.MkdirAll(config.PartialDir, 0777)
+	file, err := os.OpenFile(partialPath(sha256), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("Error opening partial file: %v", err)
+	}
+
+	// Whatever arrived is kept, even if the transfer breaks
+	_, err = io.CopyBuffer(file, src, make([]byte, config.BufferSize))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Store a completed partial file as a record, verifying it first. The partial
+// is removed once stored, or when its content turns out to be wrong.
+func commitPartial(filePath string, sha256 string, size int64) error {
+	file, err := os.Open(partialPath(sha256))
+	if err != nil {
+		return fmt.Errorf("Error opening partial file: %v", err)
+	}
+	err = receiveRecord(filePath, file, size, sha256)
+	file.Close()
+
+	if err == nil || partialSize(sha256) >= size {
+		removePartial(sha256)
+	}
+	return err
+}
+
+// Discard a partial file that can't be resumed
+func removePartial(sha256 string) {
+	os.Remove(partialPath(sha256))
+	forgetPartial(sha256)
+}
+
+// Remove partial files abandoned long ago. The others count against the
+// total partial limits, as their peers aren't known anymore.
+func cleanPartials() {
+	entries, err := ioutil.ReadDir(config.PartialDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) > PartialMaxAge {
+			if err := os.Remove(filepath.Join(config.PartialDir, entry.Name())); err == nil {
+				log.Printf("Removed stale partial transfer %s", entry.Name())
+			}
+			continue
+		}
+
+		sha256 := strings.TrimSuffix(entry.Name(), ".part")
+		if IsValidSHA256(sha256) {
+			partialsInUseMutex.Lock()
+			partialUploads[sha256] = partialUpload{size: entry.Size()}
+			partialsInUseMutex.Unlock()
+		}
+	}
+}
+
+// Receive an upload from a peer into its partial file, storing it once
+// complete
+func receivePartialUpload(header TransferHeader, src io.Reader, owner string) error {
+	sha256 := strings.ToLower(header.SHA256)
+	if !IsValidSHA256(sha256) {
+		return fmt.Errorf("Resumable upload of %s needs its SHA-256", header.Path)
+	}
+	if _, err := parseRecord(header.Path); err != nil {
+		return err
+	}
+
+	unlock, err := lockPartial(sha256)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if partialSize(sha256) > header.Size {
+		removePartial(sha256)
+	}
+	if err := reservePartial(sha256, owner, header.Size, p2pLimits()); err != nil {
+		return err
+	}
+	if err := appendPartial(sha256, header.Offset, src); err != nil {
+		return err
+	}
+	return commitPartial(header.Path, sha256, header.Size)
+}
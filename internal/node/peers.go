@@ -0,0 +1,466 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// P2P security settings
+const (
+	// Peer allowlist and P2P security settings, unless configured
+	DefaultPeersFile = "peers.json"
+
+	// Certificate presented on the P2P port, generated on first start in
+	// the TLS directory
+	DefaultTLSDir = "tls"
+	TLSCertFile   = "cert.pem"
+	TLSKeyFile    = "key.pem"
+
+	// First byte of a TLS handshake record
+	tlsHandshakeByte = 0x16
+)
+
+// Peer known to this node
+type Peer struct {
+	Address     string `json:"address,omitempty"`     // host:port to sync with
+	Name        string `json:"name,omitempty"`        // Identity the peer presents with its pre-shared key
+	TLS         bool   `json:"tls,omitempty"`         // Connect to the peer over TLS
+	Fingerprint string `json:"fingerprint,omitempty"` // SHA-256 of the peer's certificate
+	PSK         string `json:"psk,omitempty"`         // Key shared with the peer, proved by both sides
+	Interval    string `json:"interval,omitempty"`    // How often to sync, like "30m", or "off"
+	Transfers   int    `json:"transfers,omitempty"`   // Transfers kept in flight with the peer
+}
+
+// Contents of the peers file
+type PeersConfig struct {
+	Name              string `json:"name,omitempty"`      // This node's identity when using pre-shared keys
+	TLS               bool   `json:"tls"`                 // Serve TLS on the P2P port
+	AllowPlaintext    bool   `json:"allow_plaintext"`     // Still accept plain connections when TLS is on
+	RequireKnownPeers bool   `json:"require_known_peers"` // Only serve peers authenticated by the allowlist
+	SyncInterval      string `json:"sync_interval"`       // Default interval of scheduled syncs
+
+	// Peer discovery
+	Gossip           bool   `json:"gossip"`                      // Exchange known peers with the peers synced
+	SyncDiscovered   bool   `json:"sync_discovered"`             // Also sync with discovered peers the allowlist or discovery key authenticates
+	DiscoveryPSK     string `json:"discovery_psk,omitempty"`     // Key shared by every node of the network, authenticating any node proving it
+	LANDiscovery     bool   `json:"lan_discovery"`               // Announce and discover nodes on the local network
+	DiscoveryAddress string `json:"discovery_address,omitempty"` // Multicast or broadcast address of LAN discovery
+	AdvertiseAddress string `json:"advertise_address,omitempty"` // host:port other nodes should use to reach this one
+
+	// Sync concurrency and bandwidth
+	MaxConcurrentSyncs int   `json:"max_concurrent_syncs,omitempty"` // Peers synced at the same time
+	TransfersPerPeer   int   `json:"transfers_per_peer,omitempty"`   // Transfers kept in flight with each peer
+	DownloadLimit      int64 `json:"download_limit,omitempty"`       // Bytes per second received from all peers, 0 for no limit
+	UploadLimit        int64 `json:"upload_limit,omitempty"`         // Bytes per second sent to all peers, 0 for no limit
+
+	// Limits of the P2P listener
+	MaxPathLength       int    `json:"max_path_length,omitempty"`        // Longest path a peer may send
+	MaxFileSize         int64  `json:"max_file_size,omitempty"`          // Largest file a peer may upload, in bytes
+	ReadTimeout         string `json:"read_timeout,omitempty"`           // Longest wait for a peer to send data, like "2m"
+	WriteTimeout        string `json:"write_timeout,omitempty"`          // Longest wait for a peer to accept data
+	MaxConnections      int    `json:"max_connections,omitempty"`        // Open P2P connections, in total
+	MaxConnectionsPerIP int    `json:"max_connections_per_ip,omitempty"` // Open P2P connections from a single IP
+
+	// Limits of interrupted uploads kept to be resumed
+	MaxPartials            int   `json:"max_partials,omitempty"`               // Partial files, in total
+	MaxPartialBytes        int64 `json:"max_partial_bytes,omitempty"`          // Bytes announced by partial uploads, in total
+	MaxPartialsPerPeer     int   `json:"max_partials_per_peer,omitempty"`      // Partial files started by a single peer
+	MaxPartialBytesPerPeer int64 `json:"max_partial_bytes_per_peer,omitempty"` // Bytes announced by a single peer's partial uploads
+
+	Peers []Peer `json:"peers"`
+}
+
+var (
+	// Settings loaded from the peers file
+	peersConfig = defaultPeersConfig()
+
+	// This node's certificate and its fingerprint
+	p2pCertificate tls.Certificate
+	p2pFingerprint string
+)
+
+// Settings used when the peers file doesn't set them
+func defaultPeersConfig() *PeersConfig {
+	return &PeersConfig{AllowPlaintext: true, Gossip: true}
+}
+
+// Load the peers file, keeping the defaults when it doesn't exist
+func loadPeersConfig() error {
+	configBytes, err := ioutil.ReadFile(config.PeersFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	loaded := defaultPeersConfig()
+	if err := json.Unmarshal(configBytes, loaded); err != nil {
+		return fmt.Errorf("Error parsing %s: %v", config.PeersFile, err)
+	}
+	if err := checkListenerTimeouts(loaded); err != nil {
+		return err
+	}
+	for i := range loaded.Peers {
+		loaded.Peers[i].Fingerprint = normalizeFingerprint(loaded.Peers[i].Fingerprint)
+	}
+	peersConfig = loaded
+	return nil
+}
+
+// Load this node's certificate, creating a self-signed one if none exists
+func loadOrCreateCertificate() error {
+	certPath := filepath.Join(config.TLSDir, TLSCertFile)
+	keyPath := filepath.Join(config.TLSDir, TLSKeyFile)
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := createCertificate(certPath, keyPath); err != nil {
+			return fmt.Errorf("Error creating certificate: %v", err)
+		}
+		log.Printf("Created self-signed P2P certificate in %s", config.TLSDir)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("Error loading certificate: %v", err)
+	}
+	p2pCertificate = certificate
+	p2pFingerprint = certificateFingerprint(certificate.Certificate[0])
+	return nil
+}
+
+// Generate a self-signed certificate and its key
+func createCertificate(certPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "p2p " + hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.TLSDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0644)
+}
+
+// SHA-256 fingerprint of a DER certificate
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Accept fingerprints written with colons or in uppercase
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
+
+// Find the allowlisted peer with a certificate fingerprint
+func peerByFingerprint(fingerprint string) (Peer, bool) {
+	for _, peer := range peersConfig.Peers {
+		if peer.Fingerprint != "" && peer.Fingerprint == fingerprint {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Find the allowlisted peer with a pre-shared key identity
+func peerByName(name string) (Peer, bool) {
+	for _, peer := range peersConfig.Peers {
+		if peer.Name != "" && peer.Name == name && peer.PSK != "" {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Find the peers file entry for an address
+func peerByAddress(address string) (Peer, bool) {
+	for _, peer := range peersConfig.Peers {
+		if peer.Address == address {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Parse a sync form line: host:port [tls] [fingerprint=<sha256>] [psk=<key>]
+// Settings from the peers file apply unless the line overrides them.
+func parsePeerLine(line string) (Peer, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Peer{}, fmt.Errorf("Empty peer")
+	}
+
+	peer, found := peerByAddress(fields[0])
+	if !found {
+		peer = Peer{Address: fields[0]}
+	}
+	for _, field := range fields[1:] {
+		key, value := field, ""
+		if i := strings.Index(field, "="); i >= 0 {
+			key, value = field[:i], field[i+1:]
+		}
+		switch strings.ToLower(key) {
+		case "tls":
+			peer.TLS = true
+		case "fingerprint":
+			peer.TLS = true
+			peer.Fingerprint = normalizeFingerprint(value)
+		case "psk":
+			peer.PSK = value
+		default:
+			return Peer{}, fmt.Errorf("Unknown peer option %q for %s", key, peer.Address)
+		}
+	}
+	return peer, nil
+}
+
+// TLS settings of the P2P listener. Client certificates are requested so
+// peers can be recognized by fingerprint, but checked by the session.
+func serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p2pCertificate},
+		ClientAuth:   tls.RequestClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// TLS settings for connecting to a peer. Certificates are self-signed, so
+// the peer is verified by fingerprint when one is configured, and otherwise
+// by its pre-shared key proof, bound to the TLS connection.
+func clientTLSConfig(peer Peer) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{p2pCertificate},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("Peer sent no certificate")
+			}
+			if peer.Fingerprint != "" && certificateFingerprint(rawCerts[0]) != peer.Fingerprint {
+				return fmt.Errorf("Certificate fingerprint mismatch for %s", peer.Address)
+			}
+			return nil
+		},
+	}
+}
+
+// Connection whose first bytes were already read
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Negotiate TLS on an incoming P2P connection when the peer starts a TLS
+// handshake. Returns the connection to use and the name of the peer when its
+// certificate is in the allowlist.
+func acceptP2PConnection(conn net.Conn) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+	firstByte, err := reader.Peek(1)
+	if err != nil {
+		return nil, "", err
+	}
+	conn = &peekedConn{Conn: conn, reader: reader}
+
+	if firstByte[0] != tlsHandshakeByte {
+		if peersConfig.TLS && !peersConfig.AllowPlaintext {
+			return nil, "", fmt.Errorf("Plaintext connection refused from %s", conn.RemoteAddr())
+		}
+		return conn, "", nil
+	}
+	if !peersConfig.TLS {
+		return nil, "", fmt.Errorf("TLS connection refused from %s: TLS is disabled", conn.RemoteAddr())
+	}
+
+	tlsConn := tls.Server(conn, serverTLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, "", fmt.Errorf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+	}
+
+	peerName := ""
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		fingerprint := certificateFingerprint(certs[0].Raw)
+		if peer, found := peerByFingerprint(fingerprint); found {
+			peerName = peer.Name
+			if peerName == "" {
+				peerName = fingerprint
+			}
+		}
+	}
+	return tlsConn, peerName, nil
+}
+
+// Connect to a peer, over TLS if configured, and authenticate with its
+// pre-shared key if one is set. The connection is closed when ctx ends or
+// the handshakes take longer than HandshakeTimeout, and later when the peer
+// stops making progress for the listener timeouts.
+func dialPeer(ctx context.Context, peer Peer) (*Session, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	rawConn, err := dialer.DialContext(ctx, "tcp", peer.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting: %v", err)
+	}
+	limits := p2pLimits()
+	conn := net.Conn(&deadlineConn{Conn: rawConn, readTimeout: limits.ReadTimeout, writeTimeout: limits.WriteTimeout})
+
+	stop := closeOnCancel(ctx, rawConn, HandshakeTimeout)
+	session, err := startPeerSession(conn, peer)
+	if stopErr := stop(); stopErr != nil {
+		if err == nil {
+			session.Close()
+		}
+		return nil, fmt.Errorf("Error connecting: %v", stopErr)
+	}
+	return session, err
+}
+
+// Run the TLS and session handshakes with a peer
+func startPeerSession(conn net.Conn, peer Peer) (*Session, error) {
+	// Any certificate would do without a fingerprint or key to check, and
+	// the connection would only look secured
+	if peer.TLS && peer.Fingerprint == "" && peer.PSK == "" {
+		conn.Close()
+		return nil, fmt.Errorf("TLS peer %s has no fingerprint or pre-shared key to verify it with", peer.Address)
+	}
+	if peer.TLS {
+		tlsConn := tls.Client(conn, clientTLSConfig(peer))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Error connecting: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	session, err := startSession(conn)
+	if err != nil {
+		return nil, err
+	}
+	if peer.PSK != "" {
+		if err := session.Authenticate(peersConfig.Name, peer.PSK); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("Error authenticating: %v", err)
+		}
+	}
+	return session, nil
+}
+
+// Roles proving a pre-shared key, so one side's proof can't be replayed as
+// the other's
+const (
+	pskClientRole = "client"
+	pskServerRole = "server"
+)
+
+// Label of the TLS exporter binding pre-shared key proofs to a connection
+const pskExporterLabel = "EXPORTER-p2p-session-psk"
+
+// Keying material tying pre-shared key proofs to a TLS connection, so a
+// proof relayed from another connection fails. Plain connections have
+// none: there both sides still prove the key, but a relay between them
+// can take the session over once they have, so use TLS with peers that
+// aren't on a trusted network.
+func channelBinding(conn net.Conn) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	state := tlsConn.ConnectionState()
+	return state.ExportKeyingMaterial(pskExporterLabel, nil, 32)
+}
+
+// Proof of a pre-shared key by one side of a session, over the server's
+// challenge, the client's nonce and the TLS binding
+func pskMAC(psk string, role string, name string, challenge []byte, nonce []byte, binding []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	for _, part := range [][]byte{[]byte(role), []byte(name), challenge, nonce, binding} {
+		// Length prefixed so parts can't be shifted into each other
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		mac.Write(length)
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// Name given to nodes authenticated by the discovery key without a name
+const discoveryPeerName = "discovery"
+
+// Check a client's pre-shared key proof, returning the authenticated peer:
+// the allowlist entry with the name proved, or any node proving the
+// discovery key
+func verifyPSK(auth AuthRequest, challenge []byte, binding []byte) (Peer, bool) {
+	proof, err := hex.DecodeString(auth.MAC)
+	if err != nil {
+		return Peer{}, false
+	}
+	nonce, err := hex.DecodeString(auth.Nonce)
+	if err != nil || len(nonce) != SessionChallengeSize {
+		return Peer{}, false
+	}
+	proves := func(psk string) bool {
+		return hmac.Equal(proof, pskMAC(psk, pskClientRole, auth.Name, challenge, nonce, binding))
+	}
+
+	if peer, found := peerByName(auth.Name); found && proves(peer.PSK) {
+		return peer, true
+	}
+	if peersConfig.DiscoveryPSK != "" && proves(peersConfig.DiscoveryPSK) {
+		peer := Peer{Name: auth.Name, PSK: peersConfig.DiscoveryPSK}
+		if peer.Name == "" {
+			peer.Name = discoveryPeerName
+		}
+		return peer, true
+	}
+	return Peer{}, false
+}
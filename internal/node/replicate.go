@@ -0,0 +1,363 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+)
+
+// Largest record other than content blobs accepted from a peer
+const MaxRecordSize = 16 * 1024 * 1024
+
+// Kinds of records replicated between peers
+const (
+	RecordBlob     = "blob"     // data/<hash>/<hash>.<ext>
+	RecordLink     = "link"     // data/<category>/<hash>.<ext>, empty marker
+	RecordIndex    = "index"    // data/<hash>/index.json
+	RecordPage     = "page"     // data/<hash>/index.html, rendered from index.json
+	RecordThread   = "thread"   // data/<hash>/thread.json
+	RecordMetadata = "metadata" // metadata/<hash>.json
+	RecordOwner    = "owner"    // owners/<hash>
+)
+
+// Stored file classified by its path
+type Record struct {
+	Kind string
+
+	// Folder of data records, content hash of metadata and owner records
+	Hash string
+
+	// Content hash and extension of blobs and links
+	FileHash  string
+	Extension string
+}
+
+// Classify a store path into a record
+func parseRecord(filePath string) (Record, error) {
+	if err := checkStorePath(filePath); err != nil {
+		return Record{}, err
+	}
+
+	parts := strings.Split(filePath, "/")
+	invalid := fmt.Errorf("Unknown record: %s", filePath)
+
+	switch parts[0] {
+	case MetadataDir:
+		if len(parts) != 2 || !strings.HasSuffix(parts[1], ".json") {
+			return Record{}, invalid
+		}
+		hash := strings.TrimSuffix(parts[1], ".json")
+		if !IsValidSHA256(hash) {
+			return Record{}, invalid
+		}
+		return Record{Kind: RecordMetadata, Hash: hash}, nil
+
+	case OwnersDir:
+		if len(parts) != 2 || !IsValidSHA256(parts[1]) {
+			return Record{}, invalid
+		}
+		return Record{Kind: RecordOwner, Hash: parts[1]}, nil
+	}
+
+	if len(parts) != 3 || !IsValidSHA256(parts[1]) {
+		return Record{}, invalid
+	}
+	record := Record{Hash: parts[1]}
+
+	switch parts[2] {
+	case "index.json":
+		record.Kind = RecordIndex
+	case "index.html":
+		record.Kind = RecordPage
+	case "thread.json":
+		record.Kind = RecordThread
+	default:
+		// Content is always stored with an extension
+		dot := strings.Index(parts[2], ".")
+		if dot < 0 || dot == len(parts[2])-1 || !IsValidSHA256(parts[2][:dot]) {
+			return Record{}, invalid
+		}
+		record.FileHash = parts[2][:dot]
+		record.Extension = parts[2][dot+1:]
+		if record.FileHash == record.Hash {
+			record.Kind = RecordBlob
+		} else {
+			record.Kind = RecordLink
+		}
+	}
+	return record, nil
+}
+
+// Records whose copies are merged rather than kept as first written
+func (r Record) Mergeable() bool {
+	return r.Kind == RecordIndex || r.Kind == RecordThread || r.Kind == RecordPage
+}
+
+// Read a small record sent by a peer
+func readRecord(src io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(src, MaxRecordSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxRecordSize {
+		return nil, fmt.Errorf("Record larger than %d bytes", MaxRecordSize)
+	}
+	return data, nil
+}
+
+// Reader checking the size and SHA-256 of a transfer once it reaches EOF,
+// so a bad transfer fails before anything is committed to the store
+type verifyingReader struct {
+	filePath     string
+	src          io.Reader
+	hasher       hash.Hash
+	expectedSize int64  // -1 when unknown
+	expectedSHA  string // Empty when unknown
+	size         int64
+}
+
+func newVerifyingReader(filePath string, src io.Reader, expectedSize int64, expectedSHA string) *verifyingReader {
+	return &verifyingReader{
+		filePath:     filePath,
+		src:          src,
+		hasher:       sha256.New(),
+		expectedSize: expectedSize,
+		expectedSHA:  strings.ToLower(expectedSHA),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.hasher.Write(p[:n])
+	r.size += int64(n)
+
+	if err == io.EOF {
+		if r.expectedSize >= 0 && r.size != r.expectedSize {
+			return n, fmt.Errorf("Size mismatch for %s: expected %d bytes, got %d", r.filePath, r.expectedSize, r.size)
+		}
+		if actual := hex.EncodeToString(r.hasher.Sum(nil)); r.expectedSHA != "" && actual != r.expectedSHA {
+			return n, fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", r.filePath, r.expectedSHA, actual)
+		}
+	}
+	return n, err
+}
+
+// Store a record received from a peer at the same path it has there.
+// The data must match the expected size and SHA-256 when they are given
+// (size -1 and an empty hash when unknown); blobs are always checked
+// against the hash in their path.
+func receiveRecord(filePath string, src io.Reader, expectedSize int64, expectedSHA string) error {
+	record, err := parseRecord(filePath)
+	if err != nil {
+		return err
+	}
+
+	expectedSHA = strings.ToLower(expectedSHA)
+	if record.Kind == RecordBlob {
+		if expectedSHA != "" && expectedSHA != record.FileHash {
+			return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", filePath, record.FileHash, expectedSHA)
+		}
+		expectedSHA = record.FileHash
+	}
+	src = newVerifyingReader(filePath, src, expectedSize, expectedSHA)
+
+	switch record.Kind {
+	case RecordBlob:
+		// Content from peers passes the policy uploads do, and is only
+		// taken under the extension this node would give it, so a peer
+		// can't get a page or a script served under a harmless name
+		head := make([]byte, sniffLength)
+		headSize, err := io.ReadFull(src, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		head = head[:headSize]
+		contentType := detectContentType(head)
+		if fileExtension := contentExtension(record.Extension, contentType); fileExtension != record.Extension {
+			return fmt.Errorf("Refused %s: %s content is stored as .%s", filePath, contentType, fileExtension)
+		}
+		if err := checkContentPolicy(record.Extension, record.Extension, contentType); err != nil {
+			return fmt.Errorf("Refused %s: %v", filePath, err)
+		}
+
+		fileHash, _, err := store.Put(io.MultiReader(bytes.NewReader(head), src), record.Extension)
+		if err != nil {
+			return err
+		}
+		reindexContent(fileHash)
+		return nil
+
+	case RecordLink:
+		// Markers carry no content, but the transfer is still checked
+		if _, err := io.Copy(ioutil.Discard, src); err != nil {
+			return err
+		}
+		return store.Link(record.Hash, record.FileHash+"."+record.Extension)
+
+	case RecordIndex, RecordPage:
+		data, err := readRecord(src)
+		if err != nil {
+			return err
+		}
+
+		var entries []IndexEntry
+		if record.Kind == RecordPage {
+			entries = parseLegacyIndex(string(data))
+		} else {
+			var index Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				return fmt.Errorf("Invalid index %s: %v", filePath, err)
+			}
+			entries = index.Entries
+		}
+
+		added, err := mergeIndexEntries(record.Hash, entries)
+		if err != nil {
+			return fmt.Errorf("Error merging index %s: %v", filePath, err)
+		}
+		for _, entry := range added {
+			categoryHash := record.Hash
+			if categoryHash == entry.FileHash {
+				categoryHash = ""
+			}
+			if err := searchIndex.Add(entry, categoryHash, loadMetadata(entry.FileHash)); err != nil {
+				log.Printf("Error updating search index: %v", err)
+			}
+		}
+		return nil
+
+	case RecordThread:
+		data, err := readRecord(src)
+		if err != nil {
+			return err
+		}
+		var node ThreadNode
+		if err := json.Unmarshal(data, &node); err != nil {
+			return fmt.Errorf("Invalid thread %s: %v", filePath, err)
+		}
+		node.Hash = record.Hash
+		return mergeThreadNode(&node)
+
+	case RecordMetadata:
+		data, err := readRecord(src)
+		if err != nil {
+			return err
+		}
+		var metadata Metadata
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return fmt.Errorf("Invalid metadata %s: %v", filePath, err)
+		}
+		if err := store.PutMetadata(record.Hash, &metadata); err != nil {
+			return err
+		}
+		reindexContent(record.Hash)
+		return nil
+
+	case RecordOwner:
+		data, err := readRecord(src)
+		if err != nil {
+			return err
+		}
+		return store.PutOwner(record.Hash, string(data))
+	}
+	return nil
+}
+
+// Refresh the search document of content whose blob or metadata arrived
+func reindexContent(fileHash string) {
+	index, _, err := readIndex(fileHash)
+	if err != nil {
+		return
+	}
+	for _, entry := range index.Entries {
+		if entry.FileHash == fileHash {
+			if err := searchIndex.Add(entry, "", loadMetadata(fileHash)); err != nil {
+				log.Printf("Error updating search index: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// Decide whether a record should be sent to a side that has the given copy.
+// Missing records are always sent, differing copies only when they merge;
+// metadata and owner records keep the first version written.
+func shouldTransfer(filePath string, source ManifestEntry, destination ManifestEntry, destinationHas bool) bool {
+	if !destinationHas {
+		return true
+	}
+	if source.SHA256 != "" && source.SHA256 == destination.SHA256 {
+		return false
+	}
+	record, err := parseRecord(filePath)
+	return err == nil && record.Mergeable()
+}
+
+// Records a sync transfers each way, and those both sides have already
+type syncPlan struct {
+	Downloads  []string
+	Uploads    []string
+	Skipped    int
+	BytesSaved int64
+}
+
+// Compare the manifests of a server and of this node. Pages are rendered
+// from index.json, so they are only taken from peers without one.
+func planSync(serverManifest []ManifestEntry, localManifest []ManifestEntry) syncPlan {
+	var plan syncPlan
+	localEntries := make(map[string]ManifestEntry, len(localManifest))
+	for _, entry := range localManifest {
+		localEntries[entry.Path] = entry
+	}
+	serverEntries := make(map[string]ManifestEntry, len(serverManifest))
+	for _, entry := range serverManifest {
+		serverEntries[entry.Path] = entry
+	}
+	serverIndexed := indexedFolders(serverManifest)
+	localIndexed := indexedFolders(localManifest)
+
+	for _, entry := range serverManifest {
+		local, found := localEntries[entry.Path]
+		if found && entry.SHA256 != "" && local.SHA256 == entry.SHA256 {
+			plan.Skipped++
+			plan.BytesSaved += entry.Size
+			continue
+		}
+		if path.Base(entry.Path) == "index.html" && serverIndexed[path.Dir(entry.Path)] {
+			continue
+		}
+		if shouldTransfer(entry.Path, entry, local, found) {
+			plan.Downloads = append(plan.Downloads, entry.Path)
+		}
+	}
+
+	for _, entry := range localManifest {
+		if path.Base(entry.Path) == "index.html" && localIndexed[path.Dir(entry.Path)] {
+			continue
+		}
+		serverEntry, found := serverEntries[entry.Path]
+		if shouldTransfer(entry.Path, entry, serverEntry, found) {
+			plan.Uploads = append(plan.Uploads, entry.Path)
+		}
+	}
+	return plan
+}
+
+// Folders whose index.json is listed, used to skip their rendered pages
+func indexedFolders(manifest []ManifestEntry) map[string]bool {
+	folders := make(map[string]bool)
+	for _, entry := range manifest {
+		if path.Base(entry.Path) == "index.json" {
+			folders[path.Dir(entry.Path)] = true
+		}
+	}
+	return folders
+}
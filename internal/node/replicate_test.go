@@ -0,0 +1,218 @@
+package node
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+	hash := sha256Hash("content")
+	category := sha256Hash("category")
+	tests := []struct {
+		filePath string
+		kind     string
+	}{
+		{"data/" + hash + "/" + hash + ".txt", RecordBlob},
+		{"data/" + category + "/" + hash + ".txt", RecordLink},
+		{"data/" + hash + "/index.json", RecordIndex},
+		{"data/" + hash + "/index.html", RecordPage},
+		{"data/" + hash + "/thread.json", RecordThread},
+		{"metadata/" + hash + ".json", RecordMetadata},
+		{"owners/" + hash, RecordOwner},
+		{"data/" + hash + "/notes.txt", ""},
+		{"data/" + hash + "/" + hash, ""},
+		{"data/" + hash + "/" + hash + ".", ""},
+		{"data/" + category + "/" + hash + ".", ""},
+		{"data/" + hash, ""},
+		{"data/" + hash + "/" + hash + ".txt/x", ""},
+		{"metadata/" + hash + ".txt", ""},
+		{"owners/" + hash + "/x", ""},
+	}
+	for _, filePath := range traversalPaths() {
+		tests = append(tests, struct {
+			filePath string
+			kind     string
+		}{filePath, ""})
+	}
+
+	for _, test := range tests {
+		record, err := parseRecord(test.filePath)
+		if test.kind == "" {
+			if err == nil {
+				t.Errorf("parseRecord(%q) = %s record, want an error", test.filePath, record.Kind)
+			}
+			continue
+		}
+		if err != nil || record.Kind != test.kind {
+			t.Errorf("parseRecord(%q) = %q, %v, want %q", test.filePath, record.Kind, err, test.kind)
+		}
+	}
+}
+
+func TestReceiveBlobPolicy(t *testing.T) {
+	memoryStore := useMemoryStore(t)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+	tests := []struct {
+		content   string
+		extension string
+		valid     bool
+	}{
+		{"plain text", "txt", true},
+		{"<html><script>alert(1)</script></html>", "txt", true},
+		{png, "png", true},
+		{png, "html", false},
+		{"<html><script>alert(1)</script></html>", "html", true},
+		{"<?php echo 1; ?>", "txt", false},
+		{"<?php echo 1; ?>", "php", false},
+		{"plain text", "exe", false},
+	}
+
+	for _, test := range tests {
+		fileHash := sha256Hash(test.content)
+		filePath := blobPath(fileHash, test.extension)
+		err := receiveRecord(filePath, strings.NewReader(test.content), int64(len(test.content)), "")
+		if test.valid != (err == nil) {
+			t.Errorf("receiveRecord(%q) = %v", filePath, err)
+		}
+		if _, statErr := memoryStore.Stat(filePath); test.valid != (statErr == nil) {
+			t.Errorf("%s stored: %v, want %v", filePath, statErr == nil, test.valid)
+		}
+	}
+}
+
+func TestReceiveIndexEntries(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+	category := sha256Hash("category")
+	fileHash := sha256Hash("content")
+	entries := []IndexEntry{
+		{FileHash: sha256Hash("valid"), Extension: "txt", Name: "notes.txt", ContentType: "text/plain"},
+		{FileHash: fileHash, Extension: "x/../../../metadata/" + fileHash + ".json", Name: "traversal"},
+		{FileHash: fileHash, Extension: "TXT", Name: "uppercase"},
+		{FileHash: fileHash, Extension: "txt", Name: "reply", ReplyTo: "../" + fileHash},
+		{FileHash: fileHash, Extension: "txt", Name: "nul\x00name"},
+		{FileHash: fileHash, Extension: "txt", Name: strings.Repeat("x", maxIndexNameLength+1)},
+		{FileHash: fileHash, Extension: "txt", Name: "type", ContentType: "text/html; charset=utf-8"},
+		{FileHash: fileHash, Extension: "txt", Name: "type", ContentType: "text/html\"><script>"},
+		{FileHash: "not a hash", Extension: "txt", Name: "hash"},
+	}
+	data, err := json.Marshal(Index{Hash: category, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := indexJSONPath(category)
+	if err := receiveRecord(filePath, strings.NewReader(string(data)), int64(len(data)), ""); err != nil {
+		t.Fatalf("receiveRecord(%q) = %v", filePath, err)
+	}
+	index, err := loadIndex(category)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Entries) != 1 || index.Entries[0].Name != "notes.txt" {
+		t.Errorf("merged entries = %+v, want only notes.txt", index.Entries)
+	}
+}
+
+// Keep partial files in an empty temporary directory for the test
+func usePartialDir(t *testing.T) {
+	previousDir, previousUploads := config.PartialDir, partialUploads
+	config.PartialDir = filepath.Join(t.TempDir(), DefaultPartialDir)
+	partialUploads = make(map[string]partialUpload)
+	t.Cleanup(func() { config.PartialDir, partialUploads = previousDir, previousUploads })
+}
+
+// Interrupted uploads are kept to be resumed, but only within the limits
+func TestPartialUploadLimits(t *testing.T) {
+	useMemoryStore(t)
+	usePartialDir(t)
+	previousPeers := peersConfig
+	t.Cleanup(func() { peersConfig = previousPeers })
+	peersConfig = defaultPeersConfig()
+	peersConfig.MaxPartials = 3
+	peersConfig.MaxPartialsPerPeer = 2
+	peersConfig.MaxPartialBytesPerPeer = 150
+
+	// Uploads stop after a few bytes, leaving their partial file
+	upload := func(content string, size int64, offset int64, owner string) error {
+		fileHash := sha256Hash(content)
+		header := TransferHeader{Path: blobPath(fileHash, "txt"), Size: size, SHA256: fileHash, Offset: offset}
+		return receivePartialUpload(header, strings.NewReader("abc"), owner)
+	}
+	tests := []struct {
+		content string
+		size    int64
+		offset  int64
+		owner   string
+		refused bool
+	}{
+		{"first", 100, 0, "a", false},
+		{"second", 100, 0, "a", true}, // Beyond a's bytes
+		{"second", 50, 0, "a", false},
+		{"first", 100, 3, "b", false}, // Resuming counts against a
+		{"third", 10, 0, "a", true},   // Beyond a's partials
+		{"third", 10, 0, "b", false},
+		{"fourth", 10, 0, "c", true}, // Beyond the partials in total
+	}
+	for _, test := range tests {
+		err := upload(test.content, test.size, test.offset, test.owner)
+		if refused := err != nil && strings.Contains(err.Error(), "Too many"); refused != test.refused {
+			t.Errorf("Upload of %s by %s = %v, want refused %v", test.content, test.owner, err, test.refused)
+		}
+	}
+
+	// Removed partials no longer count
+	removePartial(sha256Hash("first"))
+	if err := upload("fourth", 10, 0, "c"); err != nil && strings.Contains(err.Error(), "Too many") {
+		t.Errorf("Upload after a partial was removed = %v", err)
+	}
+}
+
+// Records both sides have with the same hash are skipped, and only records
+// that merge are exchanged when they differ
+func TestPlanSync(t *testing.T) {
+	shared, serverOnly, localOnly := sha256Hash("shared"), sha256Hash("server"), sha256Hash("local")
+	category := sha256Hash("category")
+	entry := func(filePath string, content string, size int64) ManifestEntry {
+		return ManifestEntry{Path: filePath, Size: size, SHA256: sha256Hash(content)}
+	}
+
+	serverManifest := []ManifestEntry{
+		entry(blobPath(shared, "txt"), "shared", 100),
+		entry(blobPath(serverOnly, "txt"), "server", 10),
+		entry(indexJSONPath(category), "server index", 20),
+		entry(indexHTMLPath(category), "server page", 30),
+		entry("metadata/"+shared+".json", "server metadata", 40),
+		entry(threadPath(shared), "thread", 50),
+		{Path: "owners/" + shared, Size: 60},
+	}
+	localManifest := []ManifestEntry{
+		entry(blobPath(shared, "txt"), "shared", 100),
+		entry(blobPath(localOnly, "txt"), "local", 10),
+		entry(indexJSONPath(category), "local index", 20),
+		entry(indexHTMLPath(category), "local page", 30),
+		entry("metadata/"+shared+".json", "local metadata", 40),
+		entry(threadPath(shared), "thread", 50),
+		entry("owners/"+shared, "owner", 60),
+	}
+
+	plan := planSync(serverManifest, localManifest)
+	want := syncPlan{
+		Downloads:  []string{blobPath(serverOnly, "txt"), indexJSONPath(category)},
+		Uploads:    []string{blobPath(localOnly, "txt"), indexJSONPath(category)},
+		Skipped:    2,
+		BytesSaved: 150,
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("planSync() = %+v, want %+v", plan, want)
+	}
+
+	// Pages are taken from peers that have no index.json
+	plan = planSync([]ManifestEntry{entry(indexHTMLPath(category), "legacy page", 30)}, nil)
+	if len(plan.Downloads) != 1 || plan.Downloads[0] != indexHTMLPath(category) {
+		t.Errorf("planSync() of a legacy page = %+v, want it downloaded", plan)
+	}
+}
@@ -0,0 +1,417 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync scheduler settings
+const (
+	// Per-peer sync state and history of sync runs, unless configured
+	DefaultSyncStateFile = "sync_state.json"
+
+	// Interval used when neither the peer nor the peers file sets one
+	DefaultSyncInterval = 15 * time.Minute
+
+	// Longest wait between attempts to sync a failing peer
+	MaxSyncBackoff = 6 * time.Hour
+
+	// How often the scheduler looks for peers due for a sync
+	SchedulerTick = 10 * time.Second
+
+	// Sync runs kept in the history, and files listed per run
+	MaxSyncHistory      = 200
+	MaxSyncHistoryItems = 50
+)
+
+// Sync state of a scheduled peer
+type PeerSyncState struct {
+	Address     string    `json:"address"`
+	LastSync    time.Time `json:"last_sync"`
+	LastSuccess time.Time `json:"last_success"`
+	LastStatus  string    `json:"last_status"`
+	Failures    int       `json:"failures"`
+	NextSync    time.Time `json:"next_sync"`
+	Running     bool      `json:"running"`
+}
+
+// Sync run in the history
+type SyncRun struct {
+	Time            time.Time `json:"time"`
+	Trigger         string    `json:"trigger"` // "scheduled" or "manual"
+	DownloadedCount int       `json:"downloaded_count"`
+	UploadedCount   int       `json:"uploaded_count"`
+	SyncResult
+}
+
+// Scheduler state, saved to the sync state file after every run
+type SyncState struct {
+	mutex   sync.Mutex
+	Peers   map[string]*PeerSyncState `json:"peers"`
+	History []SyncRun                 `json:"history"`
+}
+
+// State used by the scheduler and the sync form
+var syncState = &SyncState{Peers: make(map[string]*PeerSyncState)}
+
+// Load the saved state, starting empty when there is none
+func (st *SyncState) Load() error {
+	stateBytes, err := ioutil.ReadFile(config.SyncStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if err := json.Unmarshal(stateBytes, st); err != nil {
+		return err
+	}
+	if st.Peers == nil {
+		st.Peers = make(map[string]*PeerSyncState)
+	}
+	// Runs cut short by a restart
+	for _, peerState := range st.Peers {
+		peerState.Running = false
+	}
+	return nil
+}
+
+// Write the state to disk. Must be called with the mutex held.
+func (st *SyncState) save() error {
+	return writeJSONFile(config.SyncStateFile, st)
+}
+
+// Write a value as JSON through a temporary file, so readers never see
+// a partly written file
+func writeJSONFile(filePath string, value interface{}) error {
+	valueBytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+"_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(valueBytes)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filePath)
+}
+
+// State of a peer, created on first use. Must be called with the mutex held.
+func (st *SyncState) peer(address string) *PeerSyncState {
+	peerState, found := st.Peers[address]
+	if !found {
+		peerState = &PeerSyncState{Address: address}
+		st.Peers[address] = peerState
+	}
+	return peerState
+}
+
+// Mark a scheduled peer as running, unless it already is
+func (st *SyncState) start(address string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	peerState := st.peer(address)
+	if peerState.Running {
+		return false
+	}
+	peerState.Running = true
+	return true
+}
+
+// Record the result of a sync run. Scheduled runs also plan the next one,
+// backing off exponentially while the peer keeps failing.
+func (st *SyncState) Record(trigger string, result SyncResult, interval time.Duration) {
+	now := time.Now()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	peerState := st.peer(result.Server)
+	peerState.LastSync = now
+	peerState.LastStatus = result.Status
+	if result.Status == "error" {
+		peerState.Failures++
+	} else {
+		peerState.LastSuccess = now
+		peerState.Failures = 0
+	}
+
+	if trigger == "scheduled" {
+		peerState.Running = false
+		delay := interval
+		for i := 0; i < peerState.Failures && delay < MaxSyncBackoff; i++ {
+			delay *= 2
+		}
+		if delay > MaxSyncBackoff {
+			delay = MaxSyncBackoff
+		}
+		peerState.NextSync = now.Add(delay)
+	}
+
+	run := SyncRun{
+		Time:            now,
+		Trigger:         trigger,
+		DownloadedCount: len(result.Downloaded),
+		UploadedCount:   len(result.Uploaded),
+		SyncResult:      result,
+	}
+	run.Downloaded = truncateList(run.Downloaded, MaxSyncHistoryItems)
+	run.Uploaded = truncateList(run.Uploaded, MaxSyncHistoryItems)
+	run.Errors = truncateList(run.Errors, MaxSyncHistoryItems)
+
+	st.History = append([]SyncRun{run}, st.History...)
+	if len(st.History) > MaxSyncHistory {
+		st.History = st.History[:MaxSyncHistory]
+	}
+
+	if err := st.save(); err != nil {
+		log.Printf("Error saving sync state: %v", err)
+	}
+}
+
+func truncateList(list []string, max int) []string {
+	if len(list) > max {
+		return list[:max]
+	}
+	return list
+}
+
+// Copy of the state for display
+func (st *SyncState) Snapshot() ([]PeerSyncState, []SyncRun) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	peers := make([]PeerSyncState, 0, len(st.Peers))
+	for _, peer := range ScheduledPeers() {
+		if _, scheduled := peerSyncInterval(peer); scheduled {
+			peers = append(peers, *st.peer(peer.Address))
+		}
+	}
+	history := make([]SyncRun, len(st.History))
+	copy(history, st.History)
+	return peers, history
+}
+
+// Peers from the peers file, followed by the discovered peers it or the
+// discovery key can authenticate when they are synced too. Discovery can't point syncs at
+// hosts the peers file doesn't vouch for.
+func ScheduledPeers() []Peer {
+	peers := peersConfig.Peers
+	if !peersConfig.SyncDiscovered {
+		return peers
+	}
+
+	peers = append([]Peer{}, peers...)
+	for _, knownPeer := range knownPeers.List(MaxKnownPeers) {
+		if _, configured := peerByAddress(knownPeer.Address); configured {
+			continue
+		}
+		if peer, trusted := discoveredPeer(knownPeer); trusted {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// Sync interval of a peer from the peers file; false when it isn't scheduled
+func peerSyncInterval(peer Peer) (time.Duration, bool) {
+	if peer.Address == "" {
+		return 0, false
+	}
+
+	setting := peer.Interval
+	if setting == "" {
+		setting = peersConfig.SyncInterval
+	}
+	if setting == "" {
+		return DefaultSyncInterval, true
+	}
+	if setting == "off" {
+		return 0, false
+	}
+
+	interval, err := time.ParseDuration(setting)
+	if err != nil || interval <= 0 {
+		return 0, false
+	}
+	return interval, true
+}
+
+// Sync every scheduled peer when it is due, for as long as the server runs
+func runSyncScheduler() {
+	for _, peer := range peersConfig.Peers {
+		if interval, scheduled := peerSyncInterval(peer); scheduled {
+			log.Printf("Syncing with %s every %s", peer.Address, interval)
+		} else if peer.Address != "" && peer.Interval != "off" {
+			log.Printf("Not scheduling %s: invalid sync interval", peer.Address)
+		}
+	}
+
+	ticker := time.NewTicker(SchedulerTick)
+	defer ticker.Stop()
+
+	for {
+		for _, peer := range ScheduledPeers() {
+			interval, scheduled := peerSyncInterval(peer)
+			if !scheduled {
+				continue
+			}
+
+			syncState.mutex.Lock()
+			due := !time.Now().Before(syncState.peer(peer.Address).NextSync)
+			syncState.mutex.Unlock()
+			if !due || !syncState.start(peer.Address) {
+				continue
+			}
+
+			go func(peer Peer, interval time.Duration) {
+				result := p2pSyncWithServer(context.Background(), peer, true)
+				syncState.Record("scheduled", result, interval)
+				if result.Status == "error" {
+					log.Printf("Scheduled sync with %s failed: %s", peer.Address, strings.Join(result.Errors, "; "))
+				}
+			}(peer, interval)
+		}
+
+		<-ticker.C
+	}
+}
+
+var syncStatusTemplate = template.Must(template.New("sync").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>P2P Sync Status</title>
+    <link rel='stylesheet' href='/default.css'>
+    <style>
+        table { border-collapse: collapse; margin-bottom: 20px; }
+        th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+        .error { color: #c00; }
+        .details { font-size: 0.85em; color: #666; }
+    </style>
+</head>
+<body>
+    <p><a href="/">Home</a></p>
+    <h2>Scheduled peers</h2>
+    {{if .Peers}}
+    <table>
+        <tr><th>Peer</th><th>Status</th><th>Last sync</th><th>Last success</th><th>Failures</th><th>Next sync</th></tr>
+        {{range .Peers}}
+        <tr>
+            <td>{{.Address}}</td>
+            <td class="{{.LastStatus}}">{{if .Running}}running{{else}}{{.LastStatus}}{{end}}</td>
+            <td>{{if not .LastSync.IsZero}}{{.LastSync.Format "2006-01-02 15:04:05"}}{{end}}</td>
+            <td>{{if not .LastSuccess.IsZero}}{{.LastSuccess.Format "2006-01-02 15:04:05"}}{{end}}</td>
+            <td>{{.Failures}}</td>
+            <td>{{if not .NextSync.IsZero}}{{.NextSync.Format "2006-01-02 15:04:05"}}{{end}}</td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <p class="details">No peers are scheduled. Add peers with an address to peers.json.</p>
+    {{end}}
+    {{if .KnownPeers}}
+    <h2>Discovered peers</h2>
+    <table>
+        <tr><th>Peer</th><th>Node</th><th>Source</th><th>Last seen</th></tr>
+        {{range .KnownPeers}}
+        <tr>
+            <td>{{.Address}}{{if .TLS}} (tls){{end}}</td>
+            <td class="details">{{.NodeID}}</td>
+            <td>{{.Source}}{{if .Relayed}} (relayed){{end}}</td>
+            <td>{{.LastSeen.Format "2006-01-02 15:04:05"}}</td>
+        </tr>
+        {{end}}
+    </table>
+    {{end}}
+    <h2>History</h2>
+    {{range .History}}
+    <div>
+        <strong>{{.Time.Format "2006-01-02 15:04:05"}}</strong> {{.Server}} ({{.Trigger}})
+        <span class="{{.Status}}">{{.Status}}</span>
+        <div class="details">
+            {{.DownloadedCount}} downloaded, {{.UploadedCount}} uploaded, {{.Skipped}} skipped, {{.BytesSaved}} bytes saved, {{.ElapsedTime}}
+        </div>
+        {{range .Errors}}<div class="details error">{{.}}</div>{{end}}
+    </div>
+    {{else}}
+    <p class="details">No sync has run yet.</p>
+    {{end}}
+</body>
+</html>`))
+
+// Handler for /sync
+func syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	peers, history := syncState.Snapshot()
+	discovered := knownPeers.List(MaxKnownPeers)
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"peers": peers, "known_peers": discovered, "history": history})
+		return
+	}
+
+	data := struct {
+		Peers      []PeerSyncState
+		KnownPeers []KnownPeer
+		History    []SyncRun
+	}{peers, discovered, history}
+	if err := syncStatusTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+// GET /api/v1/sync
+func apiSyncStatus(w http.ResponseWriter, r *http.Request) {
+	peers, history := syncState.Snapshot()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"peers": peers, "known_peers": knownPeers.List(MaxKnownPeers), "history": history})
+}
+
+// Body of POST /api/v1/sync
+type SyncRequest struct {
+	Peers []string `json:"peers"` // Sync form lines, the scheduled peers when empty
+}
+
+// POST /api/v1/sync
+//
+// Syncs now and returns the results once every peer is done. Closing the
+// request cancels the syncs.
+func apiRunSync(w http.ResponseWriter, r *http.Request) {
+	var request SyncRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&request)
+	if err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "Invalid sync request")
+		return
+	}
+
+	var results []SyncResult
+	if len(request.Peers) > 0 {
+		results = SyncPeerLines(r.Context(), request.Peers)
+	} else {
+		results = SyncPeers(r.Context(), ScheduledPeers())
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
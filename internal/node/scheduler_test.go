@@ -0,0 +1,81 @@
+package node
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Keep the sync state in a temporary file for the test
+func useSyncStateFile(t *testing.T) string {
+	previous := config.SyncStateFile
+	config.SyncStateFile = filepath.Join(t.TempDir(), DefaultSyncStateFile)
+	t.Cleanup(func() { config.SyncStateFile = previous })
+	return config.SyncStateFile
+}
+
+// Peer state and history survive a restart, failing peers back off, and
+// runs cut short by the restart aren't reported running
+func TestSyncStatePersisted(t *testing.T) {
+	useSyncStateFile(t)
+	failing, working, interrupted := "failing:8080", "working:8080", "interrupted:8080"
+	failure := SyncResult{Server: failing, Status: "error", Errors: []string{"connection refused"}}
+
+	state := &SyncState{Peers: make(map[string]*PeerSyncState)}
+	if err := state.Load(); err != nil {
+		t.Fatalf("Load without a state file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		state.start(failing)
+		state.Record("scheduled", failure, time.Minute)
+	}
+	downloaded := make([]string, MaxSyncHistoryItems+10)
+	for i := range downloaded {
+		downloaded[i] = fmt.Sprintf("data/%d", i)
+	}
+	state.start(working)
+	state.Record("scheduled", SyncResult{Server: working, Status: "success", Downloaded: downloaded}, time.Hour)
+	state.start(interrupted)
+	state.Record("manual", SyncResult{Server: interrupted, Status: "success"}, time.Hour)
+
+	loaded := &SyncState{Peers: make(map[string]*PeerSyncState)}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	failingState := loaded.Peers[failing]
+	if failingState == nil || failingState.Failures != 3 || failingState.LastStatus != "error" || !failingState.LastSuccess.IsZero() {
+		t.Fatalf("failing peer state = %+v, want 3 failures", failingState)
+	}
+	if delay := failingState.NextSync.Sub(failingState.LastSync); delay != 8*time.Minute {
+		t.Errorf("failing peer next synced after %s, want 8m", delay)
+	}
+	workingState := loaded.Peers[working]
+	if workingState == nil || workingState.Failures != 0 || workingState.LastSuccess.IsZero() || workingState.NextSync.Sub(workingState.LastSync) != time.Hour {
+		t.Errorf("working peer state = %+v, want synced every hour", workingState)
+	}
+	if interruptedState := loaded.Peers[interrupted]; interruptedState == nil || interruptedState.Running {
+		t.Errorf("interrupted peer state = %+v, want not running", interruptedState)
+	}
+
+	if len(loaded.History) != 5 || loaded.History[0].Server != interrupted || loaded.History[0].Trigger != "manual" {
+		t.Fatalf("history = %+v, want the 5 runs, latest first", loaded.History)
+	}
+	if run := loaded.History[1]; run.DownloadedCount != len(downloaded) || len(run.Downloaded) != MaxSyncHistoryItems {
+		t.Errorf("run lists %d of %d downloads, want %d", len(run.Downloaded), run.DownloadedCount, MaxSyncHistoryItems)
+	}
+}
+
+// Backing off never waits longer than MaxSyncBackoff
+func TestSyncBackoffLimit(t *testing.T) {
+	useSyncStateFile(t)
+	address := "failing:8080"
+	state := &SyncState{Peers: make(map[string]*PeerSyncState)}
+	for i := 0; i < 20; i++ {
+		state.Record("scheduled", SyncResult{Server: address, Status: "error"}, time.Hour)
+	}
+	if delay := state.Peers[address].NextSync.Sub(state.Peers[address].LastSync); delay != MaxSyncBackoff {
+		t.Errorf("next sync after %s, want %s", delay, MaxSyncBackoff)
+	}
+}
@@ -0,0 +1,790 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Search index settings
+const (
+	// Directory holding the inverted index, unless configured
+	DefaultSearchDir = "search"
+
+	// Largest amount of text content indexed per upload
+	MaxIndexedContent = 1024 * 1024
+
+	// Results returned when no limit is given
+	DefaultSearchLimit = 50
+)
+
+// Weight of each field when scoring
+var searchFieldWeights = map[string]float64{
+	"title":       3,
+	"name":        2,
+	"user":        2,
+	"description": 1.5,
+	"url":         1,
+	"content":     1,
+}
+
+// Extensions whose content is indexed as text
+var textExtensions = map[string]bool{
+	"txt": true, "md": true, "csv": true, "json": true, "xml": true,
+	"html": true, "htm": true, "log": true,
+}
+
+// Indexed content
+type SearchDocument struct {
+	FileHash   string    `json:"file_hash"`
+	Extension  string    `json:"extension"`
+	Name       string    `json:"name"`
+	Categories []string  `json:"categories"`
+	Metadata   *Metadata `json:"metadata,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Ranked search hit
+type SearchResult struct {
+	*SearchDocument
+	Score float64 `json:"score"`
+}
+
+// Search query with its filters
+type SearchQuery struct {
+	Text      string
+	Category  string
+	Extension string
+	Limit     int
+}
+
+// Inverted index mapping terms to weighted postings, saved to the search directory
+type SearchIndex struct {
+	mutex     sync.RWMutex
+	Documents map[string]*SearchDocument    `json:"documents"`
+	Postings  map[string]map[string]float64 `json:"postings"`
+
+	// Sorted terms for prefix lookups, rebuilt when the index changes
+	terms []string
+
+	// Terms of each document, to remove its postings when it changes
+	documentTerms map[string][]string
+
+	// Documents journaled since the snapshot was written
+	journaled int
+
+	// Snapshot followed and how far its journal was read, to catch up with
+	// what other processes sharing the directory journal
+	loaded        bool
+	snapshot      string
+	journalOffset int64
+
+	// Journal as last read or written here, to notice cheaply when another
+	// process changed it
+	journalInfo os.FileInfo
+}
+
+// Journal line: a document as indexed and its term weights. The first line
+// names the snapshot the journal follows.
+type searchJournalEntry struct {
+	Snapshot string             `json:"snapshot,omitempty"`
+	Document *SearchDocument    `json:"document,omitempty"`
+	Weights  map[string]float64 `json:"weights,omitempty"`
+}
+
+// Index used by the HTTP server
+var searchIndex = NewSearchIndex()
+
+// Create an empty search index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		Documents:     make(map[string]*SearchDocument),
+		Postings:      make(map[string]map[string]float64),
+		documentTerms: make(map[string][]string),
+	}
+}
+
+// The index is saved as a snapshot and a journal of the documents indexed
+// since, so adding content only appends a line
+func searchIndexPath() string {
+	return filepath.Join(config.SearchDir, "index.json")
+}
+
+func searchJournalPath() string {
+	return filepath.Join(config.SearchDir, "journal.jsonl")
+}
+
+// Documents journaled before the snapshot is written again
+const searchJournalLimit = 1000
+
+// Split text into lowercase terms
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	terms := fields[:0]
+	for _, field := range fields {
+		if len(field) > 1 {
+			terms = append(terms, field)
+		}
+	}
+	return terms
+}
+
+// Load the index from disk, rebuilding it from the store when missing
+func (idx *SearchIndex) Load() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	unlock, err := lockSearchDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = idx.reload()
+	if os.IsNotExist(err) {
+		return idx.rebuild()
+	}
+	return err
+}
+
+// Read the snapshot and apply its journal. The caller holds the mutex and
+// the directory lock.
+func (idx *SearchIndex) reload() error {
+	indexBytes, err := ioutil.ReadFile(searchIndexPath())
+	if err != nil {
+		return err
+	}
+
+	loaded := NewSearchIndex()
+	if err := json.Unmarshal(indexBytes, loaded); err != nil {
+		return err
+	}
+	idx.Documents, idx.Postings = loaded.Documents, loaded.Postings
+	idx.documentTerms = make(map[string][]string)
+	for term, postings := range idx.Postings {
+		for fileHash := range postings {
+			idx.documentTerms[fileHash] = append(idx.documentTerms[fileHash], term)
+		}
+	}
+	idx.terms = nil
+
+	idx.loaded, idx.snapshot, idx.journalOffset, idx.journaled = true, "", 0, 0
+	return idx.replayJournal()
+}
+
+// Apply the journal from the offset read so far
+func (idx *SearchIndex) replayJournal() error {
+	journalFile, err := os.Open(searchJournalPath())
+	if os.IsNotExist(err) {
+		idx.journalInfo = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer journalFile.Close()
+
+	if _, err := journalFile.Seek(idx.journalOffset, io.SeekStart); err != nil {
+		return err
+	}
+	journalBytes, err := ioutil.ReadAll(journalFile)
+	if err != nil {
+		return err
+	}
+	idx.journalOffset += int64(len(journalBytes))
+	idx.journalInfo, _ = journalFile.Stat()
+
+	for _, line := range bytes.Split(journalBytes, []byte("\n")) {
+		var entry searchJournalEntry
+		// A line cut short by a crash is skipped
+		if json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+		if entry.Snapshot != "" {
+			idx.snapshot = entry.Snapshot
+		}
+		if entry.Document == nil {
+			continue
+		}
+		idx.apply(entry.Document, entry.Weights)
+		idx.journaled++
+	}
+	return nil
+}
+
+// Snapshot the journal on disk was started for, from its first line
+func journalSnapshot() (string, error) {
+	journalFile, err := os.Open(searchJournalPath())
+	if err != nil {
+		return "", err
+	}
+	defer journalFile.Close()
+
+	line, err := bufio.NewReader(journalFile).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	var entry searchJournalEntry
+	json.Unmarshal(line, &entry)
+	return entry.Snapshot, nil
+}
+
+// Apply what other processes sharing the search directory journaled since
+// this one last read it. A journal started for another snapshot means the
+// index was written again, and is read again. The caller holds the mutex
+// and the directory lock.
+func (idx *SearchIndex) catchUp() error {
+	if idx.loaded {
+		snapshot, err := journalSnapshot()
+		if err == nil && snapshot == idx.snapshot {
+			return idx.replayJournal()
+		}
+	}
+
+	err := idx.reload()
+	if os.IsNotExist(err) {
+		return idx.rebuild()
+	}
+	return err
+}
+
+// Write the snapshot and start an empty journal, named after the snapshot
+// so other processes can tell it was replaced
+func (idx *SearchIndex) save() error {
+	indexBytes, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := writeSearchFile(searchIndexPath(), indexBytes); err != nil {
+		return err
+	}
+
+	snapshotID := make([]byte, 16)
+	if _, err := rand.Read(snapshotID); err != nil {
+		return err
+	}
+	snapshot := hex.EncodeToString(snapshotID)
+	header, err := json.Marshal(searchJournalEntry{Snapshot: snapshot})
+	if err != nil {
+		return err
+	}
+	header = append(header, '\n')
+	if err := writeSearchFile(searchJournalPath(), header); err != nil {
+		return err
+	}
+	idx.loaded, idx.snapshot, idx.journalOffset, idx.journaled = true, snapshot, int64(len(header)), 0
+	idx.journalInfo, _ = os.Stat(searchJournalPath())
+	return nil
+}
+
+// Check whether the journal changed since this process last read or wrote
+// it, without taking the directory lock
+func (idx *SearchIndex) journalChanged() bool {
+	info, err := os.Stat(searchJournalPath())
+	if err != nil {
+		return idx.journalInfo != nil
+	}
+	last := idx.journalInfo
+	return last == nil || !os.SameFile(info, last) || info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime())
+}
+
+// Catch up with the journal when another process changed it. The caller
+// holds the mutex.
+func (idx *SearchIndex) refresh() error {
+	if !idx.journalChanged() {
+		return nil
+	}
+	unlock, err := lockSearchDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return idx.catchUp()
+}
+
+// Take the lock serializing writes to the search directory, shared with
+// the other processes using it
+func lockSearchDir() (func(), error) {
+	os.MkdirAll(config.SearchDir, 0777)
+	lock, err := os.OpenFile(filepath.Join(config.SearchDir, ".lock"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
+
+// Replace a file of the index through a temporary file
+func writeSearchFile(fileName string, data []byte) error {
+	os.MkdirAll(config.SearchDir, 0777)
+	tempFile, err := ioutil.TempFile(config.SearchDir, ".index_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), fileName)
+}
+
+// Append a document to the journal, writing the snapshot instead once the
+// journal is long. The caller holds the mutex and the directory lock, and
+// caught up with the journal.
+func (idx *SearchIndex) journal(doc *SearchDocument, weights map[string]float64) error {
+	if idx.journaled >= searchJournalLimit {
+		return idx.save()
+	}
+
+	line, err := json.Marshal(searchJournalEntry{Document: doc, Weights: weights})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	journalFile, err := os.OpenFile(searchJournalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = journalFile.Write(line)
+	if err == nil {
+		idx.journalInfo, _ = journalFile.Stat()
+	}
+	if closeErr := journalFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	idx.journalOffset += int64(len(line))
+	idx.journaled++
+	return nil
+}
+
+// Rebuild the index from every folder index and metadata record in the
+// store, reading legacy index pages of folders without index.json
+func (idx *SearchIndex) Rebuild() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	unlock, err := lockSearchDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return idx.rebuild()
+}
+
+// Rebuild the index used by the HTTP server from the store
+func RebuildSearchIndex() error {
+	return searchIndex.Rebuild()
+}
+
+// Rebuild the index and write it. The caller holds the mutex and the
+// directory lock.
+func (idx *SearchIndex) rebuild() error {
+	fileList, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	idx.Documents = make(map[string]*SearchDocument)
+	idx.Postings = make(map[string]map[string]float64)
+	idx.documentTerms = make(map[string][]string)
+	idx.terms = nil
+
+	seen := make(map[string]bool)
+	for _, filePath := range fileList {
+		name := path.Base(filePath)
+		if name != "index.json" && name != "index.html" {
+			continue
+		}
+		folderHash := path.Base(path.Dir(filePath))
+		if seen[folderHash] || !IsValidSHA256(folderHash) {
+			continue
+		}
+		seen[folderHash] = true
+
+		index, _, err := readIndex(folderHash)
+		if err != nil {
+			log.Printf("Error reading index %s: %v", filePath, err)
+			continue
+		}
+		for _, entry := range index.Entries {
+			categoryHash := ""
+			if entry.FileHash != folderHash {
+				categoryHash = folderHash
+			}
+			content := readTextContent(entry.FileHash, entry.Extension)
+			idx.add(entry, categoryHash, loadMetadata(entry.FileHash), content)
+		}
+	}
+
+	return idx.save()
+}
+
+// Read the metadata record of a file, if any
+func loadMetadata(fileHash string) *Metadata {
+	metadataBytes, err := store.ReadFile(path.Join(MetadataDir, fileHash+".json"))
+	if err != nil {
+		return nil
+	}
+	var metadata Metadata
+	if json.Unmarshal(metadataBytes, &metadata) != nil {
+		return nil
+	}
+	return &metadata
+}
+
+// Read the beginning of text content for indexing
+func readTextContent(fileHash string, fileExtension string) string {
+	if !textExtensions[strings.ToLower(fileExtension)] {
+		return ""
+	}
+	file, err := store.Get(blobPath(fileHash, fileExtension))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	content, _ := ioutil.ReadAll(io.LimitReader(file, MaxIndexedContent))
+	return string(content)
+}
+
+// Add content to the index and journal it
+func (idx *SearchIndex) Add(entry IndexEntry, categoryHash string, metadata *Metadata) error {
+	content := readTextContent(entry.FileHash, entry.Extension)
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	unlock, err := lockSearchDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Another process may have indexed content since, which the journal or
+	// a new snapshot must keep
+	if err := idx.catchUp(); err != nil {
+		return err
+	}
+	doc, weights := idx.add(entry, categoryHash, metadata, content)
+	return idx.journal(doc, weights)
+}
+
+// Add content to the index without saving it, returning the document and
+// its term weights. The caller holds the mutex.
+func (idx *SearchIndex) add(entry IndexEntry, categoryHash string, metadata *Metadata, content string) (*SearchDocument, map[string]float64) {
+	doc := &SearchDocument{
+		FileHash:   entry.FileHash,
+		Extension:  entry.Extension,
+		Name:       entry.Name,
+		Categories: []string{},
+		Time:       entry.Time,
+	}
+	if existing, exists := idx.Documents[entry.FileHash]; exists {
+		copied := *existing
+		copied.Categories = append([]string(nil), existing.Categories...)
+		doc = &copied
+	}
+	if categoryHash != "" {
+		doc.Categories, _ = appendUnique(doc.Categories, categoryHash)
+	}
+	if doc.Metadata == nil && metadata != nil && *metadata != (Metadata{}) {
+		doc.Metadata = metadata
+	}
+
+	// Weigh the terms of every field
+	weights := make(map[string]float64)
+	addField := func(field string, text string) {
+		for _, term := range tokenize(text) {
+			weights[term] += searchFieldWeights[field]
+		}
+	}
+	addField("name", doc.Name)
+	addField("name", doc.Extension)
+	if doc.Metadata != nil {
+		addField("user", doc.Metadata.User)
+		addField("title", doc.Metadata.Title)
+		addField("description", doc.Metadata.Description)
+		addField("url", doc.Metadata.URL)
+	}
+	addField("content", content)
+
+	idx.apply(doc, weights)
+	return doc, weights
+}
+
+// Put a document in the index, replacing its postings. The caller holds
+// the mutex.
+func (idx *SearchIndex) apply(doc *SearchDocument, weights map[string]float64) {
+	for _, term := range idx.documentTerms[doc.FileHash] {
+		if postings := idx.Postings[term]; postings != nil {
+			delete(postings, doc.FileHash)
+			if len(postings) == 0 {
+				delete(idx.Postings, term)
+			}
+		}
+	}
+
+	terms := make([]string, 0, len(weights))
+	for term, weight := range weights {
+		if idx.Postings[term] == nil {
+			idx.Postings[term] = make(map[string]float64)
+		}
+		// Dampen repeated terms so long texts don't dominate
+		idx.Postings[term][doc.FileHash] = 1 + math.Log(weight)
+		terms = append(terms, term)
+	}
+	idx.Documents[doc.FileHash] = doc
+	idx.documentTerms[doc.FileHash] = terms
+	idx.terms = nil
+}
+
+// Sorted list of indexed terms. Sorting them takes the write lock.
+func (idx *SearchIndex) sortedTerms() []string {
+	if idx.terms == nil {
+		idx.terms = make([]string, 0, len(idx.Postings))
+		for term := range idx.Postings {
+			idx.terms = append(idx.terms, term)
+		}
+		sort.Strings(idx.terms)
+	}
+	return idx.terms
+}
+
+// Find indexed terms starting with a prefix
+func (idx *SearchIndex) termsWithPrefix(prefix string) []string {
+	terms := idx.sortedTerms()
+	var matches []string
+	for i := sort.SearchStrings(terms, prefix); i < len(terms) && strings.HasPrefix(terms[i], prefix); i++ {
+		matches = append(matches, terms[i])
+	}
+	return matches
+}
+
+// Take the read lock on an index up to date with the journal, with its
+// terms sorted. Queries share the lock; the write lock is only taken when
+// the journal must be read or the terms sorted again.
+func (idx *SearchIndex) readLock() {
+	idx.mutex.RLock()
+	if idx.terms != nil && !idx.journalChanged() {
+		return
+	}
+	idx.mutex.RUnlock()
+
+	for {
+		idx.mutex.Lock()
+		// Include what other processes indexed, like a put next to the server
+		if err := idx.refresh(); err != nil {
+			log.Printf("Error reading search index: %v", err)
+		}
+		idx.sortedTerms()
+		idx.mutex.Unlock()
+
+		// Content added in between unsorts the terms again
+		idx.mutex.RLock()
+		if idx.terms != nil {
+			return
+		}
+		idx.mutex.RUnlock()
+	}
+}
+
+// Run a ranked query. Every query term must match a term exactly or as a prefix.
+func (idx *SearchIndex) Search(query SearchQuery) []SearchResult {
+	idx.readLock()
+	defer idx.mutex.RUnlock()
+
+	categoryHash := ""
+	if query.Category != "" {
+		categoryHash = CheckSHA256(query.Category)
+	}
+	extension := strings.ToLower(strings.TrimPrefix(query.Extension, "."))
+
+	// Skip documents filtered out
+	matchesFilters := func(doc *SearchDocument) bool {
+		if extension != "" && strings.ToLower(doc.Extension) != extension {
+			return false
+		}
+		if categoryHash == "" {
+			return true
+		}
+		for _, category := range doc.Categories {
+			if category == categoryHash {
+				return true
+			}
+		}
+		return false
+	}
+
+	queryTerms := tokenize(query.Text)
+	scores := make(map[string]float64)
+	totalDocs := float64(len(idx.Documents))
+
+	if len(queryTerms) == 0 {
+		// Without terms, list filtered content by date
+		for fileHash, doc := range idx.Documents {
+			if (categoryHash != "" || extension != "") && matchesFilters(doc) {
+				scores[fileHash] = 0
+			}
+		}
+	}
+
+	for i, queryTerm := range queryTerms {
+		termScores := make(map[string]float64)
+		for _, term := range idx.termsWithPrefix(queryTerm) {
+			postings := idx.Postings[term]
+			idf := math.Log(1 + totalDocs/float64(len(postings)))
+
+			// Prefix matches count for less than exact ones
+			boost := 1.0
+			if term != queryTerm {
+				boost = 0.5
+			}
+			for fileHash, weight := range postings {
+				if score := weight * idf * boost; score > termScores[fileHash] {
+					termScores[fileHash] = score
+				}
+			}
+		}
+
+		// Keep documents matching every term so far
+		if i == 0 {
+			for fileHash, score := range termScores {
+				if matchesFilters(idx.Documents[fileHash]) {
+					scores[fileHash] = score
+				}
+			}
+			continue
+		}
+		for fileHash := range scores {
+			if score, found := termScores[fileHash]; found {
+				scores[fileHash] += score
+			} else {
+				delete(scores, fileHash)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for fileHash, score := range scores {
+		results = append(results, SearchResult{SearchDocument: idx.Documents[fileHash], Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Time.After(results[j].Time)
+	})
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Read a search query from request parameters
+func searchQueryFromRequest(r *http.Request) SearchQuery {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	return SearchQuery{
+		Text:      strings.TrimSpace(query.Get("q")),
+		Category:  strings.TrimSpace(query.Get("category")),
+		Extension: strings.TrimSpace(query.Get("ext")),
+		Limit:     limit,
+	}
+}
+
+var searchTemplate = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Search{{if .Query.Text}}: {{.Query.Text}}{{end}}</title>
+    <link rel='stylesheet' href='/default.css'>
+    <style>
+        .result { margin-bottom: 15px; }
+        .details { font-size: 0.85em; color: #666; }
+    </style>
+</head>
+<body>
+    <p><a href="/">Home</a></p>
+    <form method="GET" action="/search">
+        <input type="text" name="q" value="{{.Query.Text}}" placeholder="Search">
+        <input type="text" name="category" value="{{.Query.Category}}" placeholder="Category">
+        <input type="text" name="ext" value="{{.Query.Extension}}" placeholder="Extension" size="6">
+        <button type="submit">Search</button>
+    </form>
+    <p class="details">{{len .Results}} result(s)</p>
+    {{range .Results}}
+    <div class="result">
+        <a href="/data/{{.FileHash}}/{{.FileHash}}.{{.Extension}}">{{if .Metadata}}{{.Metadata.Title}}{{else}}{{.Name}}{{end}}</a>
+        <a href="/data/{{.FileHash}}/index.html">[ Open ]</a>
+        <a href="/thread/{{.FileHash}}">[ Thread ]</a>
+        <div class="details">
+            {{.Name}}{{if .Metadata}} &middot; {{.Metadata.User}} &middot; {{.Metadata.Description}}{{end}}
+            &middot; score {{printf "%.2f" .Score}}
+        </div>
+    </div>
+    {{end}}
+</body>
+</html>`))
+
+// Handler for /search
+func searchPageHandler(w http.ResponseWriter, r *http.Request) {
+	query := searchQueryFromRequest(r)
+	results := searchIndex.Search(query)
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	data := struct {
+		Query   SearchQuery
+		Results []SearchResult
+	}{query, results}
+	if err := searchTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+// GET /api/v1/search
+func apiSearch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, searchIndex.Search(searchQueryFromRequest(r)))
+}
@@ -0,0 +1,143 @@
+package node
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keep the search index of the test in a temporary directory, starting empty
+func useSearchDir(t *testing.T) string {
+	previousDir, previousIndex := config.SearchDir, searchIndex
+	config.SearchDir = filepath.Join(t.TempDir(), DefaultSearchDir)
+	searchIndex = NewSearchIndex()
+	t.Cleanup(func() {
+		config.SearchDir, searchIndex = previousDir, previousIndex
+	})
+	return config.SearchDir
+}
+
+// Two indexes sharing a directory stand for a put command next to the
+// server: neither may drop what the other added, even when it writes a new
+// snapshot
+func TestSearchIndexSharedDir(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+
+	server, command := NewSearchIndex(), NewSearchIndex()
+	if err := server.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := command.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"alpha", "bravo", "charlie", "delta"}
+	for i, name := range names {
+		idx := server
+		if i%2 == 1 {
+			idx = command
+		}
+		// Write a snapshot on every other add
+		if i >= 2 {
+			idx.journaled = searchJournalLimit
+		}
+		entry := IndexEntry{FileHash: sha256Hash(name), Extension: "txt", Name: name, Time: time.Now()}
+		if err := idx.Add(entry, "", nil); err != nil {
+			t.Fatalf("Add(%s): %v", name, err)
+		}
+	}
+
+	reloaded := NewSearchIndex()
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if reloaded.Documents[sha256Hash(name)] == nil {
+			t.Errorf("%s missing from the saved index", name)
+		}
+	}
+}
+
+// A server searching sees what a put command indexed since it loaded, also
+// after the command wrote a new snapshot
+func TestSearchSeesOtherProcesses(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+
+	server, command := NewSearchIndex(), NewSearchIndex()
+	if err := server.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := command.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"alpha", "bravo"} {
+		if i == 1 {
+			command.journaled = searchJournalLimit
+		}
+		entry := IndexEntry{FileHash: sha256Hash(name), Extension: "txt", Name: name, Time: time.Now()}
+		if err := command.Add(entry, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if results := server.Search(SearchQuery{Text: name}); len(results) != 1 {
+			t.Errorf("search for %s found %d results, want 1", name, len(results))
+		}
+	}
+}
+
+// A store with only legacy index pages is searchable on the first build
+func TestSearchIndexLegacyPages(t *testing.T) {
+	memoryStore := useMemoryStore(t)
+	useSearchDir(t)
+
+	fileHash := sha256Hash("report")
+	categoryHash := CheckSHA256("documents")
+	memoryStore.WriteFile(blobPath(fileHash, "txt"), []byte("quarterly figures"))
+	page := `<a href="../../?reply=` + fileHash + `">[ Reply ]</a> <a href="../` + fileHash + `/index.html">[ Open ]</a> ` +
+		`<a href="../` + fileHash + `/` + fileHash + `.txt">report.txt</a><br>`
+	memoryStore.WriteFile(indexHTMLPath(categoryHash), []byte(page))
+
+	idx := NewSearchIndex()
+	if err := idx.Load(); err != nil {
+		t.Fatal(err)
+	}
+	results := idx.Search(SearchQuery{Text: "quarterly", Category: "documents"})
+	if len(results) != 1 || results[0].FileHash != fileHash {
+		t.Errorf("search of a legacy store found %+v, want %s", results, fileHash)
+	}
+}
+
+// Queries run at the same time as content is added see a consistent index
+func TestSearchConcurrentQueries(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+
+	idx := NewSearchIndex()
+	if err := idx.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			name := fmt.Sprintf("document%d", i)
+			entry := IndexEntry{FileHash: sha256Hash(name), Extension: "txt", Name: name, Time: time.Now()}
+			if err := idx.Add(entry, "", nil); err != nil {
+				t.Error(err)
+			}
+			for j := 0; j < 20; j++ {
+				idx.Search(SearchQuery{Text: "document"})
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	if results := idx.Search(SearchQuery{Text: "document"}); len(results) != 8 {
+		t.Errorf("search found %d results, want 8", len(results))
+	}
+}
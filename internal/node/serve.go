@@ -0,0 +1,171 @@
+package node
+
+import (
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Files of the working directory served to the index pages
+var staticAssets = map[string]bool{
+	"default.css": true,
+	"default.js":  true,
+	"ads.js":      true,
+}
+
+// Content Security Policies. Index pages only load the static assets, and
+// raw content runs in a sandbox with no access to the origin serving it.
+const (
+	indexPagePolicy  = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; base-uri 'none'; form-action 'self'; frame-ancestors 'self'"
+	rawContentPolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+)
+
+// Types browsers display without running anything, served inline. Anything
+// else is served as a download, as are the active types among these, such
+// as SVG images which may carry scripts.
+var (
+	inlineTypes = []string{"text/plain", "application/json", "application/pdf", "image/*", "audio/*", "video/*", "application/ogg"}
+	activeTypes = []string{"image/svg+xml"}
+)
+
+// Serve a static asset of the web interface
+func serveStaticAsset(w http.ResponseWriter, r *http.Request, fileName string) bool {
+	if !staticAssets[fileName] {
+		return false
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, fileName)
+	return true
+}
+
+// Check whether a path is in the data tree, the only part of the store
+// served over HTTP. Hidden files are locks and writes in progress.
+func isDataPath(filePath string) bool {
+	return strings.HasPrefix(filePath, UploadDirBase+"/") && checkStorePath(filePath) == nil && !strings.HasPrefix(path.Base(filePath), ".")
+}
+
+// Check whether a path of the data tree is an index page rather than raw
+// content
+func isIndexPage(filePath string) bool {
+	return path.Base(filePath) == "index.html"
+}
+
+// Serve a file of the data tree, falling back to the folder's index.html.
+// Raw content is redirected to the sandbox origin when there is one.
+func serveStoredFile(w http.ResponseWriter, r *http.Request, filePath string) bool {
+	filePath = strings.TrimSuffix(filePath, "/")
+	if !isDataPath(filePath) {
+		return false
+	}
+	fileInfo, err := store.Stat(filePath)
+	if err != nil {
+		// Folders are served through their index page
+		filePath = path.Join(filePath, "index.html")
+		if fileInfo, err = store.Stat(filePath); err != nil {
+			return false
+		}
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return true
+		}
+	}
+
+	if !isIndexPage(filePath) && config.SandboxPort != "" {
+		http.Redirect(w, r, sandboxURL(r)+"/"+filePath, http.StatusFound)
+		return true
+	}
+	return sendStoredFile(w, r, filePath, fileInfo)
+}
+
+// Send a stored file with the headers keeping it from acting on the origin
+// serving it
+func sendStoredFile(w http.ResponseWriter, r *http.Request, filePath string, fileInfo ObjectInfo) bool {
+	file, err := store.Get(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	if isIndexPage(filePath) {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		header.Set("Content-Security-Policy", indexPagePolicy)
+	} else {
+		contentType := storedContentType(filePath)
+		header.Set("Content-Security-Policy", rawContentPolicy)
+		if !matchesAnyType(contentType, inlineTypes) || matchesAnyType(contentType, activeTypes) {
+			header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(filePath)}))
+		}
+		if strings.HasPrefix(contentType, "text/") {
+			contentType += "; charset=utf-8"
+		}
+		header.Set("Content-Type", contentType)
+	}
+
+	http.ServeContent(w, r, path.Base(filePath), fileInfo.ModTime, file)
+	return true
+}
+
+// Type a stored file is served as, from its extension. Text formats are
+// served as plain text, unknown ones as binary.
+func storedContentType(filePath string) string {
+	fileExtension := strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+	if fileExtension == "json" {
+		return "application/json"
+	}
+	if contentType := extensionType(fileExtension); contentType != "" {
+		return contentType
+	}
+	if plainTextExtensions[fileExtension] {
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
+
+// Address of the sandbox origin, by default the host of the request on the
+// sandbox port
+func sandboxURL(r *http.Request) string {
+	if config.SandboxURL != "" {
+		return config.SandboxURL
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, config.SandboxPort)
+}
+
+// Handler of the sandbox origin, serving raw content and nothing else
+func sandboxHandler(w http.ResponseWriter, r *http.Request) {
+	filePath := strings.TrimPrefix(r.URL.Path, "/")
+	if !isDataPath(filePath) || isIndexPage(filePath) {
+		http.NotFound(w, r)
+		return
+	}
+	fileInfo, err := store.Stat(filePath)
+	if err != nil || !sendStoredFile(w, r, filePath, fileInfo) {
+		http.NotFound(w, r)
+	}
+}
+
+// Start the sandbox origin when a port is set for it
+func startSandboxServer() {
+	if config.SandboxPort == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", sandboxHandler)
+
+	log.Printf("Sandbox server started on port %s", config.SandboxPort)
+	go func() {
+		log.Fatalf("Error starting sandbox server: %v", http.ListenAndServe(":"+config.SandboxPort, mux))
+	}()
+}
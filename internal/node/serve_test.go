@@ -0,0 +1,99 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Raw content is served so it can't act on the origin: never sniffed,
+// sandboxed, and downloaded unless browsers only display it
+func TestServeStoredFileHeaders(t *testing.T) {
+	useMemoryStore(t)
+	fileHash := sha256Hash("content")
+	tests := []struct {
+		filePath    string
+		content     string
+		contentType string
+		policy      string
+		attachment  bool
+	}{
+		{blobPath(fileHash, "txt"), "plain text", "text/plain; charset=utf-8", rawContentPolicy, false},
+		{blobPath(fileHash, "png"), "\x89PNG\r\n\x1a\n", "image/png", rawContentPolicy, false},
+		{blobPath(fileHash, "html"), "<script>alert(1)</script>", "text/html; charset=utf-8", rawContentPolicy, true},
+		{blobPath(fileHash, "svg"), "<svg onload=alert(1)>", "image/svg+xml", rawContentPolicy, true},
+		{blobPath(fileHash, "js"), "alert(1)", "text/plain; charset=utf-8", rawContentPolicy, false},
+		{blobPath(fileHash, "xyz"), "unknown", "application/octet-stream", rawContentPolicy, true},
+		{indexHTMLPath(fileHash), "<html></html>", "text/html; charset=utf-8", indexPagePolicy, false},
+	}
+
+	for _, test := range tests {
+		if err := store.WriteFile(test.filePath, []byte(test.content)); err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/"+test.filePath, nil)
+		if !serveStoredFile(recorder, request, test.filePath) {
+			t.Errorf("%s not served", test.filePath)
+			continue
+		}
+
+		header := recorder.Header()
+		if header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s served without nosniff", test.filePath)
+		}
+		if got := header.Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s served as %q, want %q", test.filePath, got, test.contentType)
+		}
+		if got := header.Get("Content-Security-Policy"); got != test.policy {
+			t.Errorf("%s served with policy %q, want %q", test.filePath, got, test.policy)
+		}
+		if attachment := strings.HasPrefix(header.Get("Content-Disposition"), "attachment"); attachment != test.attachment {
+			t.Errorf("%s served as attachment: %v, want %v", test.filePath, attachment, test.attachment)
+		}
+	}
+	if !strings.HasSuffix(rawContentPolicy, "sandbox") {
+		t.Errorf("raw content policy %q doesn't sandbox content", rawContentPolicy)
+	}
+}
+
+// Only the data tree is served: not the source, the configuration, owner
+// and metadata records, or files being written
+func TestServeStoredFileRefused(t *testing.T) {
+	fileStore := useFileStore(t)
+	fileHash := sha256Hash("content")
+	secret := "secret settings"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(fileStore.DataDir), "config.json"), []byte(secret), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, filePath := range []string{"owners/" + fileHash, "metadata/" + fileHash + ".json", "data/" + fileHash + "/.upload_1"} {
+		if err := store.WriteFile(filePath, []byte(secret)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refused := append(traversalPaths(),
+		"config.json",
+		"data/../config.json",
+		"owners/"+fileHash,
+		"metadata/"+fileHash+".json",
+		"data/"+fileHash+"/.upload_1",
+	)
+	for _, filePath := range refused {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if serveStoredFile(recorder, request, filePath) {
+			t.Errorf("%q served", filePath)
+		}
+
+		recorder = httptest.NewRecorder()
+		request.URL.Path = "/" + filePath
+		sandboxHandler(recorder, request)
+		if recorder.Code != http.StatusNotFound || strings.Contains(recorder.Body.String(), secret) {
+			t.Errorf("%q answered %d by the sandbox, want 404", filePath, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,840 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Session protocol settings
+const (
+	// Sent by both sides before any frame
+	SessionMagic = "P2PS"
+
+	// Version 3 streams lists and manifests as data frames, version 4
+	// proves pre-shared keys both ways
+	SessionVersion = byte(4)
+
+	// Size of the challenge the server sends for pre-shared key authentication
+	SessionChallengeSize = 32
+
+	// Frames carrying file data and closing a data stream
+	CmdData = byte(7)
+	CmdEnd  = byte(8)
+
+	// Authenticate the client with a pre-shared key
+	CmdAuth = byte(9)
+
+	// Ask how much of an interrupted upload the server already holds
+	CmdQueryOffset = byte(10)
+
+	// Largest payload accepted in a data frame, and in any other frame
+	MaxFramePayload   = 64 * 1024 * 1024
+	MaxControlPayload = 256 * 1024
+
+	// Requests a client keeps in flight on one session, unless configured,
+	// and the most a server handles at once on a session
+	SessionPipelineDepth = 4
+	MaxSessionRequests   = 32
+
+	// Frames buffered per request before the session reader waits
+	sessionRequestBuffer = 16
+)
+
+// Frame layout: command byte, request ID, payload size, payload
+type frame struct {
+	cmd       byte
+	requestID uint32
+	payload   []byte
+}
+
+// Payload of CmdAuth: the client's proof of the pre-shared key, and the
+// nonce the server proves it with in turn
+type AuthRequest struct {
+	Name  string `json:"name"`
+	MAC   string `json:"mac"`
+	Nonce string `json:"nonce"`
+}
+
+// Payload of the CmdSuccess answering CmdAuth
+type AuthResponse struct {
+	MAC string `json:"mac"`
+}
+
+// Header of CmdGetFile, CmdPutFile and CmdQueryOffset requests and
+// responses. Size and SHA256 describe the whole file; Offset and Length the
+// range being transferred, where a zero Length means up to the end.
+type TransferHeader struct {
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// Read one frame
+func readFrame(r io.Reader) (frame, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		cmd:       header[0],
+		requestID: binary.BigEndian.Uint32(header[1:5]),
+	}
+	payloadSize := binary.BigEndian.Uint32(header[5:9])
+	maxPayload := uint32(MaxControlPayload)
+	if f.cmd == CmdData {
+		maxPayload = MaxFramePayload
+	}
+	if payloadSize > maxPayload {
+		// The header is returned so the refusal can be answered
+		return f, fmt.Errorf("Frame payload too large: %d bytes", payloadSize)
+	}
+
+	// Memory is taken as the payload arrives, not on the word of the header
+	initialSize := payloadSize
+	if initialSize > MaxControlPayload {
+		initialSize = MaxControlPayload
+	}
+	payload := bytes.NewBuffer(make([]byte, 0, initialSize))
+	if _, err := io.CopyN(payload, r, int64(payloadSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+	f.payload = payload.Bytes()
+	return f, nil
+}
+
+// Writes whole frames to a connection shared by several requests
+type frameWriter struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+func (w *frameWriter) send(cmd byte, requestID uint32, payload []byte) error {
+	buffer := make([]byte, 9+len(payload))
+	buffer[0] = cmd
+	binary.BigEndian.PutUint32(buffer[1:5], requestID)
+	binary.BigEndian.PutUint32(buffer[5:9], uint32(len(payload)))
+	copy(buffer[9:], payload)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.conn.Write(buffer)
+	return err
+}
+
+func (w *frameWriter) sendJSON(cmd byte, requestID uint32, value interface{}) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return w.send(cmd, requestID, payload)
+}
+
+func (w *frameWriter) sendError(requestID uint32, message string) error {
+	return w.send(CmdError, requestID, []byte(message))
+}
+
+// Send a stream as data frames followed by CmdEnd
+func (w *frameWriter) sendStream(requestID uint32, src io.Reader) error {
+	buffer := make([]byte, config.BufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if sendErr := w.send(CmdData, requestID, buffer[:n]); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.send(CmdEnd, requestID, nil)
+}
+
+// Complete the handshake of a connection whose first byte was SessionMagic[0],
+// returning the challenge sent to the client
+func acceptSession(conn net.Conn) ([]byte, error) {
+	handshake := make([]byte, len(SessionMagic))
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return nil, err
+	}
+	if string(handshake[:len(SessionMagic)-1]) != SessionMagic[1:] {
+		return nil, fmt.Errorf("Invalid session handshake")
+	}
+	if version := handshake[len(SessionMagic)-1]; version != SessionVersion {
+		return nil, fmt.Errorf("Unsupported session version %d", version)
+	}
+
+	challenge := make([]byte, SessionChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	reply := append([]byte(SessionMagic), SessionVersion)
+	if _, err := conn.Write(append(reply, challenge...)); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Serve requests on a session until the peer disconnects. peerName is set
+// when the connection was already authenticated by its TLS certificate.
+func serveSession(conn net.Conn, peerName string) {
+	challenge, err := acceptSession(conn)
+	if err != nil {
+		log.Printf("Error starting P2P session: %v", err)
+		return
+	}
+
+	binding, err := channelBinding(conn)
+	if err != nil {
+		log.Printf("Error starting P2P session: %v", err)
+		return
+	}
+
+	writer := &frameWriter{conn: conn}
+	uploads := make(map[uint32]*io.PipeWriter)
+	var wg sync.WaitGroup
+
+	// Requests being handled, refused beyond MaxSessionRequests
+	requests := make(chan struct{}, MaxSessionRequests)
+	startRequest := func(requestID uint32) bool {
+		select {
+		case requests <- struct{}{}:
+			wg.Add(1)
+			return true
+		default:
+			writer.sendError(requestID, "Too many requests in flight")
+			return false
+		}
+	}
+	endRequest := func() {
+		<-requests
+		wg.Done()
+	}
+
+	defer func() {
+		// Abort uploads cut short by the disconnect
+		for _, upload := range uploads {
+			upload.CloseWithError(io.ErrUnexpectedEOF)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		f, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading P2P frame: %v", err)
+			}
+			if f.cmd != 0 {
+				writer.sendError(f.requestID, err.Error())
+			}
+			return
+		}
+
+		if f.cmd == CmdAuth {
+			var auth AuthRequest
+			if json.Unmarshal(f.payload, &auth) == nil {
+				if peer, ok := verifyPSK(auth, challenge, binding); ok {
+					// Prove the key in turn, so clients know they reached the peer
+					nonce, _ := hex.DecodeString(auth.Nonce)
+					peerName = peer.Name
+					writer.sendJSON(CmdSuccess, f.requestID, AuthResponse{
+						MAC: hex.EncodeToString(pskMAC(peer.PSK, pskServerRole, auth.Name, challenge, nonce, binding)),
+					})
+					continue
+				}
+			}
+			// A failed proof ends the session, so keys can't be guessed
+			// over one connection
+			log.Printf("Failed P2P authentication from %s", conn.RemoteAddr())
+			writer.sendError(f.requestID, "Authentication failed")
+			return
+		}
+
+		// Only allowlisted peers are served when required
+		if peersConfig.RequireKnownPeers && peerName == "" {
+			if f.cmd != CmdData && f.cmd != CmdEnd {
+				writer.sendError(f.requestID, "Authentication required")
+			}
+			continue
+		}
+
+		switch f.cmd {
+		case CmdList, CmdManifest, CmdGetFile, CmdQueryOffset:
+			if !startRequest(f.requestID) {
+				continue
+			}
+			go func(f frame) {
+				defer endRequest()
+				handleSessionRequest(writer, f)
+			}(f)
+
+		case CmdPutFile:
+			// Replacing an upload in flight would leave its receiver
+			// waiting for data forever
+			if _, found := uploads[f.requestID]; found {
+				writer.sendError(f.requestID, "Request ID already in use")
+				continue
+			}
+
+			var header TransferHeader
+			if err := json.Unmarshal(f.payload, &header); err != nil {
+				writer.sendError(f.requestID, "Invalid put request")
+				continue
+			}
+			if header.Size < 0 || header.Offset < 0 || header.Offset > header.Size {
+				writer.sendError(f.requestID, "Invalid put request")
+				continue
+			}
+			if err := checkTransferLimits(header.Path, header.Size); err != nil {
+				writer.sendError(f.requestID, err.Error())
+				continue
+			}
+
+			if !startRequest(f.requestID) {
+				continue
+			}
+
+			// Data frames for this request are piped into the store as they arrive
+			pipeReader, pipeWriter := io.Pipe()
+			uploads[f.requestID] = pipeWriter
+
+			go func(requestID uint32, header TransferHeader, owner string) {
+				defer endRequest()
+				// Records are stored at the same path they have on the peer.
+				// Large ones go through a partial file so they can be resumed.
+				// Data beyond the announced size fails the size check
+				// instead of filling the disk.
+				src := io.LimitReader(pipeReader, header.Size-header.Offset+1)
+				var err error
+				if header.Offset > 0 || (header.Size >= ResumableTransferSize && header.SHA256 != "") {
+					err = receivePartialUpload(header, src, owner)
+				} else {
+					err = receiveRecord(header.Path, src, header.Size, header.SHA256)
+				}
+				if err != nil {
+					pipeReader.CloseWithError(err)
+					writer.sendError(requestID, err.Error())
+					return
+				}
+				pipeReader.Close()
+				writer.send(CmdSuccess, requestID, []byte(fmt.Sprintf("File saved successfully: %s", header.Path)))
+			}(f.requestID, header, partialOwner(peerName, conn.RemoteAddr()))
+
+		case CmdData:
+			if upload, found := uploads[f.requestID]; found {
+				upload.Write(f.payload) // Fails once the receiver gave up, dropping the data
+			}
+
+		case CmdEnd:
+			if upload, found := uploads[f.requestID]; found {
+				upload.Close()
+				delete(uploads, f.requestID)
+			}
+
+		case CmdPeers:
+			handlePeerExchange(writer, f, conn.RemoteAddr(), peerName)
+
+		default:
+			writer.sendError(f.requestID, fmt.Sprintf("Unknown command %d", f.cmd))
+		}
+	}
+}
+
+// Answer a request that doesn't carry data
+func handleSessionRequest(writer *frameWriter, f frame) {
+	switch f.cmd {
+	case CmdList:
+		// Lists and manifests of large stores don't fit in a frame, so they
+		// are streamed like file data
+		fileList, _ := store.List()
+		writer.send(CmdSuccess, f.requestID, nil)
+		writer.sendStream(f.requestID, strings.NewReader(strings.Join(fileList, "\n")))
+
+	case CmdManifest:
+		// One JSON entry per line
+		manifest, _ := buildManifest()
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			encoder := json.NewEncoder(pipeWriter)
+			for _, entry := range manifest {
+				if err := encoder.Encode(entry); err != nil {
+					return
+				}
+			}
+			pipeWriter.Close()
+		}()
+		writer.send(CmdSuccess, f.requestID, nil)
+		if err := writer.sendStream(f.requestID, pipeReader); err != nil {
+			log.Printf("Error sending manifest: %v", err)
+		}
+		pipeReader.Close()
+
+	case CmdGetFile:
+		var header TransferHeader
+		if err := json.Unmarshal(f.payload, &header); err != nil {
+			writer.sendError(f.requestID, "Invalid get request")
+			return
+		}
+		if err := checkTransferLimits(header.Path, 0); err != nil {
+			writer.sendError(f.requestID, err.Error())
+			return
+		}
+
+		file, fileInfo, err := openPeerFile(header.Path)
+		if err != nil {
+			writer.sendError(f.requestID, err.Error())
+			return
+		}
+		defer file.Close()
+
+		// Send the requested range only
+		length := fileInfo.Size - header.Offset
+		if header.Offset < 0 || length < 0 || header.Length < 0 {
+			writer.sendError(f.requestID, fmt.Sprintf("Invalid range %d+%d for %d bytes", header.Offset, header.Length, fileInfo.Size))
+			return
+		}
+		if header.Length > 0 && header.Length < length {
+			length = header.Length
+		}
+		if _, err := file.Seek(header.Offset, io.SeekStart); err != nil {
+			writer.sendError(f.requestID, fmt.Sprintf("Error seeking file: %v", err))
+			return
+		}
+
+		// Tell the peer what to expect so it can verify the transfer
+		entry, err := manifestEntry(header.Path)
+		if err != nil {
+			writer.sendError(f.requestID, fmt.Sprintf("Error hashing file: %v", err))
+			return
+		}
+		writer.sendJSON(CmdSuccess, f.requestID, TransferHeader{
+			Path:   header.Path,
+			Size:   fileInfo.Size,
+			SHA256: entry.SHA256,
+			Offset: header.Offset,
+			Length: length,
+		})
+		if err := writer.sendStream(f.requestID, io.LimitReader(file, length)); err != nil {
+			log.Printf("Error sending file data for %s: %v", header.Path, err)
+		}
+
+	case CmdQueryOffset:
+		var header TransferHeader
+		if err := json.Unmarshal(f.payload, &header); err != nil || !IsValidSHA256(header.SHA256) {
+			writer.sendError(f.requestID, "Invalid offset query")
+			return
+		}
+
+		// Resume where the previous upload of the same content stopped
+		offset := partialSize(strings.ToLower(header.SHA256))
+		if offset > header.Size {
+			offset = 0
+		}
+		writer.sendJSON(CmdSuccess, f.requestID, TransferHeader{Path: header.Path, Size: header.Size, SHA256: header.SHA256, Offset: offset})
+	}
+}
+
+// Open a stored file requested by a peer. Only files in the store
+// directories are served.
+func openPeerFile(filePath string) (io.ReadSeekCloser, ObjectInfo, error) {
+	if err := checkStorePath(filePath); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	fileInfo, err := store.Stat(filePath)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("File not found")
+	}
+	file, err := store.Get(filePath)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("Error opening file: %v", err)
+	}
+	return file, fileInfo, nil
+}
+
+// Pending request on a client session
+type sessionRequest struct {
+	frames chan frame
+	closed chan struct{}
+}
+
+// Client side of a P2P session
+type Session struct {
+	conn    net.Conn
+	writer  *frameWriter
+	mutex   sync.Mutex
+	nextID  uint32
+	pending map[uint32]*sessionRequest
+	done    chan struct{}
+	err     error
+
+	// Sent by the server for pre-shared key authentication
+	challenge []byte
+}
+
+// Run the session handshake on an open connection
+func startSession(conn net.Conn) (*Session, error) {
+	if _, err := conn.Write(append([]byte(SessionMagic), SessionVersion)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error sending handshake: %v", err)
+	}
+
+	handshake := make([]byte, len(SessionMagic)+1+SessionChallengeSize)
+	if _, err := io.ReadFull(conn, handshake[:1]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error reading handshake (peer may not support sessions): %v", err)
+	}
+	// Peers over their connection limits answer with a single-command error
+	if handshake[0] == CmdError {
+		defer conn.Close()
+		return nil, fmt.Errorf("Peer refused the connection: %s", readP2PError(conn))
+	}
+	if _, err := io.ReadFull(conn, handshake[1:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error reading handshake (peer may not support sessions): %v", err)
+	}
+	if string(handshake[:len(SessionMagic)]) != SessionMagic || handshake[len(SessionMagic)] != SessionVersion {
+		conn.Close()
+		return nil, fmt.Errorf("Invalid handshake from peer")
+	}
+
+	session := &Session{
+		conn:      conn,
+		writer:    &frameWriter{conn: conn},
+		pending:   make(map[uint32]*sessionRequest),
+		done:      make(chan struct{}),
+		challenge: handshake[len(SessionMagic)+1:],
+	}
+	go session.readLoop()
+	return session, nil
+}
+
+// Close the session
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// Route incoming frames to their requests
+func (s *Session) readLoop() {
+	for {
+		f, err := readFrame(s.conn)
+		if err != nil {
+			s.mutex.Lock()
+			s.err = err
+			s.mutex.Unlock()
+			close(s.done)
+			return
+		}
+
+		s.mutex.Lock()
+		request := s.pending[f.requestID]
+		s.mutex.Unlock()
+		if request == nil {
+			continue // Abandoned request
+		}
+
+		select {
+		case request.frames <- f:
+		case <-request.closed:
+		}
+	}
+}
+
+// Send a request and register for its responses
+func (s *Session) start(cmd byte, payload []byte) (uint32, *sessionRequest, error) {
+	request := &sessionRequest{
+		frames: make(chan frame, sessionRequestBuffer),
+		closed: make(chan struct{}),
+	}
+
+	s.mutex.Lock()
+	s.nextID++
+	requestID := s.nextID
+	s.pending[requestID] = request
+	s.mutex.Unlock()
+
+	if err := s.writer.send(cmd, requestID, payload); err != nil {
+		s.finish(requestID)
+		return 0, nil, err
+	}
+	return requestID, request, nil
+}
+
+// Stop listening for responses to a request
+func (s *Session) finish(requestID uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if request, found := s.pending[requestID]; found {
+		close(request.closed)
+		delete(s.pending, requestID)
+	}
+}
+
+// Wait for the next frame of a request
+func (s *Session) next(request *sessionRequest) (frame, error) {
+	var f frame
+	select {
+	case f = <-request.frames:
+	case <-s.done:
+		// Frames read before the peer closed are delivered first, so a
+		// response completed just before the close isn't lost
+		select {
+		case f = <-request.frames:
+		default:
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return frame{}, fmt.Errorf("Session closed: %v", s.err)
+		}
+	}
+	if f.cmd == CmdError {
+		return f, fmt.Errorf("%s", string(f.payload))
+	}
+	return f, nil
+}
+
+// Send a request answered with a single frame
+func (s *Session) call(cmd byte, payload []byte) ([]byte, error) {
+	requestID, request, err := s.start(cmd, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer s.finish(requestID)
+
+	f, err := s.next(request)
+	if err != nil {
+		return nil, err
+	}
+	return f.payload, nil
+}
+
+// Send a request answered with CmdSuccess then data frames, returning a
+// reader over the data
+func (s *Session) callStream(cmd byte, payload []byte) (io.ReadCloser, error) {
+	requestID, request, err := s.start(cmd, payload)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.next(request); err != nil {
+		s.finish(requestID)
+		return nil, err
+	}
+	return &sessionStream{session: s, requestID: requestID, request: request}, nil
+}
+
+// Prove knowledge of a pre-shared key to the peer, and check that the peer
+// knows it too
+func (s *Session) Authenticate(name string, psk string) error {
+	binding, err := channelBinding(s.conn)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, SessionChallengeSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	payload, _ := json.Marshal(AuthRequest{
+		Name:  name,
+		MAC:   hex.EncodeToString(pskMAC(psk, pskClientRole, name, s.challenge, nonce, binding)),
+		Nonce: hex.EncodeToString(nonce),
+	})
+	response, err := s.call(CmdAuth, payload)
+	if err != nil {
+		return err
+	}
+
+	var auth AuthResponse
+	if err := json.Unmarshal(response, &auth); err != nil {
+		return fmt.Errorf("Invalid authentication response: %v", err)
+	}
+	proof, err := hex.DecodeString(auth.MAC)
+	if err != nil || !hmac.Equal(proof, pskMAC(psk, pskServerRole, name, s.challenge, nonce, binding)) {
+		return fmt.Errorf("Peer failed to prove the pre-shared key")
+	}
+	return nil
+}
+
+// Request the file list of the peer
+func (s *Session) List() ([]string, error) {
+	stream, err := s.callStream(CmdList, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file list: %v", err)
+	}
+	defer stream.Close()
+
+	listBuffer, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file list: %v", err)
+	}
+	return strings.Split(string(listBuffer), "\n"), nil
+}
+
+// Request the content manifest of the peer
+func (s *Session) Manifest() ([]ManifestEntry, error) {
+	stream, err := s.callStream(CmdManifest, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest: %v", err)
+	}
+	defer stream.Close()
+
+	manifest := []ManifestEntry{}
+	decoder := json.NewDecoder(stream)
+	for {
+		var entry ManifestEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding manifest: %v", err)
+		}
+		manifest = append(manifest, entry)
+	}
+}
+
+// Request a file from the peer, returning a reader over its data and the
+// size and hash the peer announced for it
+func (s *Session) Get(filePath string) (io.ReadCloser, TransferHeader, error) {
+	return s.GetRange(filePath, 0, 0)
+}
+
+// Request part of a file from the peer, from offset for length bytes or up
+// to the end when length is zero
+func (s *Session) GetRange(filePath string, offset int64, length int64) (io.ReadCloser, TransferHeader, error) {
+	payload, _ := json.Marshal(TransferHeader{Path: filePath, Offset: offset, Length: length})
+	requestID, request, err := s.start(CmdGetFile, payload)
+	if err != nil {
+		return nil, TransferHeader{}, err
+	}
+
+	f, err := s.next(request)
+	if err != nil {
+		s.finish(requestID)
+		return nil, TransferHeader{}, err
+	}
+	var header TransferHeader
+	if err := json.Unmarshal(f.payload, &header); err != nil {
+		s.finish(requestID)
+		return nil, TransferHeader{}, fmt.Errorf("Invalid get response: %v", err)
+	}
+
+	return &sessionStream{session: s, requestID: requestID, request: request}, header, nil
+}
+
+// Ask the peer how many bytes of an upload it already holds
+func (s *Session) QueryOffset(filePath string, size int64, sha256 string) (int64, error) {
+	payload, _ := json.Marshal(TransferHeader{Path: filePath, Size: size, SHA256: sha256})
+	response, err := s.call(CmdQueryOffset, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	var header TransferHeader
+	if err := json.Unmarshal(response, &header); err != nil {
+		return 0, fmt.Errorf("Invalid offset response: %v", err)
+	}
+	return header.Offset, nil
+}
+
+// Send a file to the peer, returning the server's confirmation. The header
+// gives the whole file's size and hash, and the offset src starts at.
+func (s *Session) Put(header TransferHeader, src io.Reader) (string, error) {
+	payload, _ := json.Marshal(header)
+	requestID, request, err := s.start(CmdPutFile, payload)
+	if err != nil {
+		return "", err
+	}
+	defer s.finish(requestID)
+
+	if err := s.writer.sendStream(requestID, src); err != nil {
+		return "", err
+	}
+
+	f, err := s.next(request)
+	if err != nil {
+		return "", err
+	}
+	return string(f.payload), nil
+}
+
+// Data frames of a CmdGetFile response
+type sessionStream struct {
+	session   *Session
+	requestID uint32
+	request   *sessionRequest
+	pending   []byte
+	err       error
+}
+
+func (r *sessionStream) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		f, err := r.session.next(r.request)
+		switch {
+		case err != nil:
+			r.err = err
+		case f.cmd == CmdEnd:
+			r.err = io.EOF
+		case f.cmd == CmdData:
+			r.pending = f.payload
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *sessionStream) Close() error {
+	r.session.finish(r.requestID)
+	return nil
+}
+
+// Run transfers keeping up to depth requests in flight. No more transfers
+// start once the context is cancelled.
+func pipelined(ctx context.Context, depth int, filePaths []string, transfer func(filePath string)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, depth)
+
+	for _, filePath := range filePaths {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(filePath string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			transfer(filePath)
+		}(filePath)
+	}
+
+	wg.Wait()
+}
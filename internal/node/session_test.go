@@ -0,0 +1,342 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Open a session with serveSession over an in-memory connection
+func startTestSession(t *testing.T) *Session {
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		// handleP2PConnection reads the first byte to choose the protocol
+		if _, err := io.ReadFull(serverConn, make([]byte, 1)); err == nil {
+			serveSession(serverConn, "")
+		}
+	}()
+
+	session, err := startSession(clientConn)
+	if err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func TestSessionGetRefused(t *testing.T) {
+	useMemoryStore(t)
+	session := startTestSession(t)
+
+	paths := append(traversalPaths(), blobPath(sha256Hash("missing"), "txt"))
+	for _, filePath := range paths {
+		if file, _, err := session.Get(filePath); err == nil {
+			file.Close()
+			t.Errorf("Get(%q) succeeded", filePath)
+		}
+	}
+	// The session still serves requests after refusing them
+	if _, err := session.List(); err != nil {
+		t.Errorf("List after refused gets: %v", err)
+	}
+}
+
+// A failed pre-shared key proof ends the session
+func TestSessionFailedAuthCloses(t *testing.T) {
+	useMemoryStore(t)
+	session := startTestSession(t)
+
+	if err := session.Authenticate("unknown", "guess"); err == nil {
+		t.Fatal("Authenticate with an unknown key succeeded")
+	}
+	if err := session.Authenticate("unknown", "another guess"); err == nil {
+		t.Fatal("second Authenticate on the session succeeded")
+	}
+	if _, err := session.List(); err == nil {
+		t.Error("List succeeded after a failed authentication")
+	}
+}
+
+// Any node proving the discovery key is authenticated, without a peers
+// file entry of its own
+func TestSessionDiscoveryKey(t *testing.T) {
+	useMemoryStore(t)
+	previous := peersConfig
+	t.Cleanup(func() { peersConfig = previous })
+	peersConfig = defaultPeersConfig()
+	peersConfig.DiscoveryPSK = "network key"
+	peersConfig.RequireKnownPeers = true
+
+	session := startTestSession(t)
+	if err := session.Authenticate("new node", "network key"); err != nil {
+		t.Fatalf("Authenticate with the discovery key: %v", err)
+	}
+	if _, err := session.List(); err != nil {
+		t.Errorf("List after authenticating with the discovery key: %v", err)
+	}
+
+	if err := startTestSession(t).Authenticate("new node", "other key"); err == nil {
+		t.Error("Authenticate with another key succeeded")
+	}
+
+	peer, trusted := discoveredPeer(KnownPeer{Address: "192.0.2.1:8081", NodeID: sha256Hash("node")})
+	if !trusted || peer.PSK != "network key" {
+		t.Errorf("discoveredPeer = %+v, %v, want the discovery key", peer, trusted)
+	}
+}
+
+// A response the peer completes just before closing the connection is
+// read in full
+func TestSessionCloseAfterEnd(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			if _, err := io.ReadFull(serverConn, make([]byte, len(SessionMagic)+1)); err != nil {
+				return
+			}
+			handshake := append([]byte(SessionMagic), SessionVersion)
+			handshake = append(handshake, make([]byte, SessionChallengeSize)...)
+			if _, err := serverConn.Write(handshake); err != nil {
+				return
+			}
+			request, err := readFrame(serverConn)
+			if err != nil {
+				return
+			}
+			writer := &frameWriter{conn: serverConn}
+			writer.send(CmdSuccess, request.requestID, nil)
+			writer.send(CmdData, request.requestID, []byte("a\nb"))
+			writer.send(CmdEnd, request.requestID, nil)
+		}()
+
+		session, err := startSession(clientConn)
+		if err != nil {
+			t.Fatalf("startSession: %v", err)
+		}
+		fileList, err := session.List()
+		session.Close()
+		if err != nil {
+			t.Fatalf("List on try %d: %v", i+1, err)
+		}
+		if strings.Join(fileList, ",") != "a,b" {
+			t.Fatalf("List on try %d = %q", i+1, fileList)
+		}
+	}
+}
+
+func TestReadFrameLimits(t *testing.T) {
+	header := func(cmd byte, size uint32) []byte {
+		buffer := []byte{cmd, 0, 0, 0, 1}
+		return binary.BigEndian.AppendUint32(buffer, size)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		valid bool
+	}{
+		{"control frame", append(header(CmdSuccess, 2), "ok"...), true},
+		{"data frame", append(header(CmdData, 4), "data"...), true},
+		{"large control frame", header(CmdGetFile, MaxControlPayload+1), false},
+		{"large data frame", header(CmdData, MaxFramePayload+1), false},
+		{"truncated payload", append(header(CmdData, MaxFramePayload), "data"...), false},
+	}
+
+	for _, test := range tests {
+		f, err := readFrame(bytes.NewReader(test.input))
+		if test.valid != (err == nil) {
+			t.Errorf("%s: readFrame = %v", test.name, err)
+		}
+		if err == nil && len(f.payload) != len(test.input)-9 {
+			t.Errorf("%s: read %d bytes of payload", test.name, len(f.payload))
+		}
+	}
+}
+
+// Request a file with the single-command protocol, returning the error sent
+func singleCommandGet(t *testing.T, filePath string) (byte, string) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go handleP2PConnection(serverConn)
+
+	request := []byte{CmdGetFile}
+	request = binary.BigEndian.AppendUint32(request, uint32(len(filePath)))
+	request = append(request, filePath...)
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("Error reading response to %q: %v", filePath, err)
+	}
+	if response[0] != CmdError {
+		return response[0], ""
+	}
+	return response[0], readP2PError(clientConn)
+}
+
+// Send content with the single-command protocol, returning the final answer
+func singleCommandPut(t *testing.T, filePath string, content string) (byte, string) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go handleP2PConnection(serverConn)
+
+	request := []byte{CmdPutFile}
+	request = binary.BigEndian.AppendUint32(request, uint32(len(filePath)))
+	request = append(request, filePath...)
+	request = binary.BigEndian.AppendUint64(request, uint64(len(content)))
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("Error reading response to %q: %v", filePath, err)
+	}
+	if response[0] == CmdError {
+		return response[0], readP2PError(clientConn)
+	}
+	if _, err := io.WriteString(clientConn, content); err != nil {
+		t.Fatalf("Error sending %q: %v", filePath, err)
+	}
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("Error reading response to %q: %v", filePath, err)
+	}
+	if response[0] != CmdError {
+		return response[0], ""
+	}
+	return response[0], readP2PError(clientConn)
+}
+
+func TestSingleCommandGetRefused(t *testing.T) {
+	useMemoryStore(t)
+
+	cmd, message := singleCommandGet(t, blobPath(sha256Hash("missing"), "txt"))
+	if cmd != CmdError || !strings.Contains(message, "not found") {
+		t.Errorf("Get of a missing file answered %d %q, want CmdError", cmd, message)
+	}
+	for _, filePath := range traversalPaths() {
+		if filePath == "" {
+			continue
+		}
+		if cmd, _ := singleCommandGet(t, filePath); cmd != CmdError {
+			t.Errorf("Get(%q) answered %d, want CmdError", filePath, cmd)
+		}
+	}
+}
+
+// Without a session nothing checks records other than blobs, whose name
+// carries their hash
+func TestSingleCommandPutBlobsOnly(t *testing.T) {
+	memoryStore := useMemoryStore(t)
+	fileHash := sha256Hash("content")
+	tests := []struct {
+		filePath string
+		content  string
+		valid    bool
+	}{
+		{blobPath(fileHash, "txt"), "content", true},
+		{blobPath(fileHash, "txt"), "other content", false},
+		{indexJSONPath(fileHash), `{"entries":[]}`, false},
+		{"metadata/" + fileHash + ".json", "{}", false},
+		{"owners/" + fileHash, "owner", false},
+	}
+
+	for _, test := range tests {
+		cmd, message := singleCommandPut(t, test.filePath, test.content)
+		if test.valid != (cmd == CmdSuccess) {
+			t.Errorf("Put(%q) answered %d %q", test.filePath, cmd, message)
+		}
+	}
+	if _, err := memoryStore.Stat(indexJSONPath(fileHash)); err == nil {
+		t.Errorf("index.json stored without a session")
+	}
+}
+
+// Content large enough to be transferred through a partial file, split
+// where a transfer was interrupted
+func resumableContent() (content []byte, fileHash string, half int64) {
+	content = bytes.Repeat([]byte("resumable content\n"), ResumableTransferSize/9)
+	return content, calculateSHA256(content), int64(len(content) / 2)
+}
+
+// An upload cut short is resumed from the offset the server reports, and
+// the completed file is checked against its hash
+func TestSessionResumeUpload(t *testing.T) {
+	useMemoryStore(t)
+	usePartialDir(t)
+	session := startTestSession(t)
+	content, fileHash, half := resumableContent()
+	filePath := blobPath(fileHash, "txt")
+	size := int64(len(content))
+
+	if err := appendPartial(fileHash, 0, bytes.NewReader(content[:half])); err != nil {
+		t.Fatal(err)
+	}
+	offset, err := session.QueryOffset(filePath, size, fileHash)
+	if err != nil || offset != half {
+		t.Fatalf("QueryOffset = %d, %v, want %d", offset, err, half)
+	}
+	header := TransferHeader{Path: filePath, Size: size, SHA256: fileHash, Offset: offset}
+	if _, err := session.Put(header, bytes.NewReader(content[offset:])); err != nil {
+		t.Fatalf("Put from %d: %v", offset, err)
+	}
+	if stored, err := store.ReadFile(filePath); err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("stored %d bytes, %v, want the %d bytes sent", len(stored), err, size)
+	}
+	if partialSize(fileHash) != 0 {
+		t.Errorf("partial file kept after the upload completed")
+	}
+
+	// A partial file holding other bytes fails the hash and is dropped
+	otherContent := append(bytes.Repeat([]byte("x"), int(half)), content[half:]...)
+	otherHash := calculateSHA256(otherContent)
+	otherPath := blobPath(otherHash, "txt")
+	if err := appendPartial(otherHash, 0, bytes.NewReader(content[:half])); err != nil {
+		t.Fatal(err)
+	}
+	header = TransferHeader{Path: otherPath, Size: size, SHA256: otherHash, Offset: half}
+	if _, err := session.Put(header, bytes.NewReader(otherContent[half:])); err == nil {
+		t.Errorf("Put completing a corrupt partial file succeeded")
+	}
+	if _, err := store.Stat(otherPath); err == nil {
+		t.Errorf("corrupt upload stored")
+	}
+	if partialSize(otherHash) != 0 {
+		t.Errorf("corrupt partial file kept")
+	}
+}
+
+// A download cut short only fetches the bytes missing from its partial file
+func TestSessionResumeDownload(t *testing.T) {
+	useMemoryStore(t)
+	usePartialDir(t)
+	session := startTestSession(t)
+	content, fileHash, half := resumableContent()
+	filePath := blobPath(fileHash, "txt")
+	if err := store.WriteFile(filePath, content); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := appendPartial(fileHash, 0, bytes.NewReader(content[:half])); err != nil {
+		t.Fatal(err)
+	}
+	// Fetching everything again would leave the partial file too large to
+	// pass the size check
+	entry := ManifestEntry{Path: filePath, Size: int64(len(content)), SHA256: fileHash}
+	if err := resumeDownload(context.Background(), session, entry); err != nil {
+		t.Fatalf("resumeDownload from %d: %v", half, err)
+	}
+	if stored, err := store.ReadFile(filePath); err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("stored %d bytes, %v, want %d", len(stored), err, len(content))
+	}
+	if partialSize(fileHash) != 0 {
+		t.Errorf("partial file kept after the download completed")
+	}
+}
@@ -0,0 +1,381 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store keeps content blobs, category links, metadata and owner records.
+// Paths are slash separated and start with UploadDirBase, OwnersDir or
+// MetadataDir, the same layout exchanged with P2P peers.
+type Store interface {
+	// Put streams content into data/<hash>/<hash>.<ext> and returns its hash and size
+	Put(src io.Reader, fileExtension string) (string, int64, error)
+	// Stage streams content into the store before its extension is known,
+	// hashing it on the way
+	Stage(src io.Reader) (StagedContent, error)
+	// Get opens a stored file for reading
+	Get(filePath string) (io.ReadSeekCloser, error)
+	// Link records a file as a member of a category
+	Link(categoryHash string, fileNameWithExtension string) error
+	// PutMetadata saves metadata for a file unless it already has some
+	PutMetadata(fileHash string, metadata *Metadata) error
+	// PutOwner saves BTC info for a file unless it already has some
+	PutOwner(fileHash string, btcInfo string) error
+	// List returns the paths of every stored file
+	List() ([]string, error)
+	// ReadDir returns the names of the files in a store folder
+	ReadDir(dirPath string) ([]string, error)
+	// Stat returns information about a stored file
+	Stat(filePath string) (ObjectInfo, error)
+	// ReadFile and WriteFile access small records such as index pages
+	ReadFile(filePath string) ([]byte, error)
+	WriteFile(filePath string, data []byte) error
+	// Lock takes an exclusive lock on a record, shared with other processes
+	// using the same directories, and returns the function releasing it
+	Lock(filePath string) (func(), error)
+}
+
+// Content staged in the store, read back to detect its type then either
+// committed to data/<hash>/<hash>.<ext> or removed
+type StagedContent interface {
+	io.ReadSeeker
+	Hash() string
+	Size() int64
+	Commit(fileExtension string) error
+	Remove()
+}
+
+// Stored file information
+type ObjectInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store used by the HTTP and P2P servers
+var store Store = NewFileStore(UploadDirBase, OwnersDir, MetadataDir)
+
+// Build the path of a content blob
+func blobPath(fileHash string, fileExtension string) string {
+	return path.Join(UploadDirBase, fileHash, fileHash+"."+fileExtension)
+}
+
+// Check that a path belongs to one of the store directories and can't
+// escape it: no absolute paths, no "." or ".." segments, no backslashes
+func checkStorePath(filePath string) error {
+	if filePath == "" || strings.HasPrefix(filePath, "/") || filepath.IsAbs(filePath) || filepath.VolumeName(filePath) != "" {
+		return fmt.Errorf("Invalid store path: %q", filePath)
+	}
+	if strings.ContainsAny(filePath, "\\\x00") {
+		return fmt.Errorf("Invalid store path: %q", filePath)
+	}
+	for _, segment := range strings.Split(filePath, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("Invalid store path: %q", filePath)
+		}
+	}
+
+	namespace := strings.SplitN(filePath, "/", 2)[0]
+	if namespace != UploadDirBase && namespace != OwnersDir && namespace != MetadataDir {
+		return fmt.Errorf("Path outside store: %s", filePath)
+	}
+	return nil
+}
+
+// Store backed by the data, owners and metadata directories
+type FileStore struct {
+	DataDir     string
+	OwnersDir   string
+	MetadataDir string
+}
+
+// Create a store using the given directories
+func NewFileStore(dataDir string, ownersDir string, metadataDir string) *FileStore {
+	return &FileStore{
+		DataDir:     dataDir,
+		OwnersDir:   ownersDir,
+		MetadataDir: metadataDir,
+	}
+}
+
+// Map a store path to its location on disk
+func (s *FileStore) localPath(filePath string) (string, error) {
+	filePath = filepath.ToSlash(filePath)
+	if err := checkStorePath(filePath); err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(filePath, "/", 2)
+	rest := ""
+	if len(parts) == 2 {
+		rest = filepath.FromSlash(parts[1])
+	}
+
+	switch parts[0] {
+	case UploadDirBase:
+		return filepath.Join(s.DataDir, rest), nil
+	case OwnersDir:
+		return filepath.Join(s.OwnersDir, rest), nil
+	case MetadataDir:
+		return filepath.Join(s.MetadataDir, rest), nil
+	}
+	return "", fmt.Errorf("Path outside store: %s", filePath)
+}
+
+func (s *FileStore) Put(src io.Reader, fileExtension string) (string, int64, error) {
+	staged, err := s.Stage(src)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error saving content: %v", err)
+	}
+	defer staged.Remove()
+	if err := staged.Commit(fileExtension); err != nil {
+		return "", 0, err
+	}
+	return staged.Hash(), staged.Size(), nil
+}
+
+// Content staged in a hidden temporary file of the data directory, so
+// committing it is a rename
+type stagedFile struct {
+	*os.File
+	store     *FileStore
+	hash      string
+	size      int64
+	committed bool
+}
+
+func (s *FileStore) Stage(src io.Reader) (StagedContent, error) {
+	os.MkdirAll(s.DataDir, 0777)
+	tempFile, err := ioutil.TempFile(s.DataDir, ".upload_*")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temporary file: %v", err)
+	}
+	staged := &stagedFile{File: tempFile, store: s}
+
+	// Hash and write in a single pass
+	hasher := sha256.New()
+	if staged.size, err = io.CopyBuffer(io.MultiWriter(tempFile, hasher), src, make([]byte, config.BufferSize)); err != nil {
+		staged.Remove()
+		return nil, err
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		staged.Remove()
+		return nil, err
+	}
+	staged.hash = hex.EncodeToString(hasher.Sum(nil))
+	return staged, nil
+}
+
+func (f *stagedFile) Hash() string { return f.hash }
+func (f *stagedFile) Size() int64  { return f.size }
+
+// Move the content into place
+func (f *stagedFile) Commit(fileExtension string) error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error saving content: %v", err)
+	}
+	os.Chmod(f.Name(), 0666)
+
+	fileUploadDir := filepath.Join(f.store.DataDir, f.hash)
+	os.MkdirAll(fileUploadDir, 0777)
+	if err := os.Rename(f.Name(), filepath.Join(fileUploadDir, f.hash+"."+fileExtension)); err != nil {
+		return fmt.Errorf("Error saving content: %v", err)
+	}
+	f.committed = true
+	return nil
+}
+
+// Delete the temporary file, unless it was committed: its name may be
+// another upload's by now
+func (f *stagedFile) Remove() {
+	f.Close()
+	if !f.committed {
+		os.Remove(f.Name())
+	}
+}
+
+func (s *FileStore) Get(filePath string) (io.ReadSeekCloser, error) {
+	localPath, err := s.localPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(localPath)
+}
+
+func (s *FileStore) Link(categoryHash string, fileNameWithExtension string) error {
+	categoryDir := filepath.Join(s.DataDir, categoryHash)
+	os.MkdirAll(categoryDir, 0777)
+
+	// Create empty file in category folder with hash + extension name,
+	// leaving an existing file as it is: it may be the content itself
+	emptyFile, err := os.OpenFile(filepath.Join(categoryDir, fileNameWithExtension), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("Error creating empty file in category folder: %v", err)
+	}
+	return emptyFile.Close()
+}
+
+func (s *FileStore) PutMetadata(fileHash string, metadata *Metadata) error {
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeIfMissing(filepath.Join(s.MetadataDir, fileHash+".json"), metadataBytes)
+}
+
+func (s *FileStore) PutOwner(fileHash string, btcInfo string) error {
+	return writeIfMissing(filepath.Join(s.OwnersDir, fileHash), []byte(btcInfo))
+}
+
+// Write a file only if it doesn't exist yet
+func writeIfMissing(filePath string, data []byte) error {
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		return nil
+	}
+	os.MkdirAll(filepath.Dir(filePath), 0777)
+	return ioutil.WriteFile(filePath, data, 0666)
+}
+
+func (s *FileStore) List() ([]string, error) {
+	var fileList []string
+
+	// Function to walk directories recursively
+	walkDir := func(namespace string, dir string) error {
+		return filepath.Walk(dir, func(localPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			// Skip uploads and records still being written, and locks
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, localPath)
+			if err != nil {
+				return err
+			}
+			fileList = append(fileList, path.Join(namespace, filepath.ToSlash(rel)))
+			return nil
+		})
+	}
+
+	// List files in each directory
+	if err := walkDir(UploadDirBase, s.DataDir); err != nil {
+		return nil, err
+	}
+	if err := walkDir(MetadataDir, s.MetadataDir); err != nil {
+		return nil, err
+	}
+	if err := walkDir(OwnersDir, s.OwnersDir); err != nil {
+		return nil, err
+	}
+
+	return fileList, nil
+}
+
+func (s *FileStore) ReadDir(dirPath string) ([]string, error) {
+	localPath, err := s.localPath(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		// Same files as List
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *FileStore) Stat(filePath string) (ObjectInfo, error) {
+	localPath, err := s.localPath(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%s is a directory", filePath)
+	}
+	return ObjectInfo{Path: filePath, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *FileStore) ReadFile(filePath string) ([]byte, error) {
+	localPath, err := s.localPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(localPath)
+}
+
+func (s *FileStore) WriteFile(filePath string, data []byte) error {
+	localPath, err := s.localPath(filePath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(localPath)
+	os.MkdirAll(dir, 0777)
+
+	// Readers see either the old record or the new one, never part of it
+	tempFile, err := ioutil.TempFile(dir, ".write_*")
+	if err != nil {
+		return err
+	}
+	tempFilePath := tempFile.Name()
+	defer os.Remove(tempFilePath) // Nothing left to remove once renamed
+
+	_, err = tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	os.Chmod(tempFilePath, 0666)
+	return os.Rename(tempFilePath, localPath)
+}
+
+// Records are locked through a hidden file next to them, which List skips
+func (s *FileStore) Lock(filePath string) (func(), error) {
+	localPath, err := s.localPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(localPath)
+	os.MkdirAll(dir, 0777)
+
+	lockFilePath := filepath.Join(dir, "."+filepath.Base(localPath)+".lock")
+	lock, err := os.OpenFile(lockFilePath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
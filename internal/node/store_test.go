@@ -0,0 +1,268 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replace the store with an empty in-memory one for the test
+func useMemoryStore(t *testing.T) *MemoryStore {
+	previous := store
+	memoryStore := NewMemoryStore()
+	store = memoryStore
+	t.Cleanup(func() { store = previous })
+	return memoryStore
+}
+
+// Replace the store with one in a temporary directory for the test
+func useFileStore(t *testing.T) *FileStore {
+	dir := t.TempDir()
+	previous := store
+	fileStore := NewFileStore(filepath.Join(dir, UploadDirBase), filepath.Join(dir, OwnersDir), filepath.Join(dir, MetadataDir))
+	store = fileStore
+	t.Cleanup(func() { store = previous })
+	return fileStore
+}
+
+// Paths a peer may try to escape the store with
+func traversalPaths() []string {
+	hash := sha256Hash("content")
+	return []string{
+		"",
+		"../u.go",
+		"data/../u.go",
+		"data/" + hash + "/../../u.go",
+		"./data/" + hash,
+		"/etc/passwd",
+		"/data/" + hash,
+		"data\\..\\u.go",
+		"data/" + hash + "\\..\\..\\u.go",
+		"data/" + hash + "/x\x00.txt",
+		"C:\\Windows\\win.ini",
+		"C:/Windows/win.ini",
+		"u.go",
+		"peers.json",
+		"tls/key.pem",
+		"partial/" + hash + ".part",
+	}
+}
+
+func TestCheckStorePath(t *testing.T) {
+	hash := sha256Hash("content")
+	valid := []string{
+		"data/" + hash + "/" + hash + ".txt",
+		"data/" + hash + "/index.json",
+		"metadata/" + hash + ".json",
+		"owners/" + hash,
+	}
+	for _, filePath := range valid {
+		if err := checkStorePath(filePath); err != nil {
+			t.Errorf("checkStorePath(%q) = %v, want nil", filePath, err)
+		}
+	}
+	for _, filePath := range traversalPaths() {
+		if err := checkStorePath(filePath); err == nil {
+			t.Errorf("checkStorePath(%q) = nil, want an error", filePath)
+		}
+	}
+}
+
+// Both stores refuse the same paths
+func TestStoreRefusesTraversal(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"FileStore":   func(t *testing.T) Store { return useFileStore(t) },
+		"MemoryStore": func(t *testing.T) Store { return useMemoryStore(t) },
+	}
+	for name, useStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore := useStore(t)
+			for _, filePath := range traversalPaths() {
+				if _, err := testStore.Stat(filePath); err == nil {
+					t.Errorf("Stat(%q) succeeded", filePath)
+				}
+				if _, err := testStore.ReadFile(filePath); err == nil {
+					t.Errorf("ReadFile(%q) succeeded", filePath)
+				}
+				if file, err := testStore.Get(filePath); err == nil {
+					file.Close()
+					t.Errorf("Get(%q) succeeded", filePath)
+				}
+				if err := testStore.WriteFile(filePath, []byte("content")); err == nil {
+					t.Errorf("WriteFile(%q) succeeded", filePath)
+				}
+				if unlock, err := testStore.Lock(filePath); err == nil {
+					unlock()
+					t.Errorf("Lock(%q) succeeded", filePath)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenPeerFile(t *testing.T) {
+	memoryStore := useMemoryStore(t)
+	hash := sha256Hash("content")
+	filePath := blobPath(hash, "txt")
+	memoryStore.WriteFile(filePath, []byte("content"))
+
+	file, info, err := openPeerFile(filePath)
+	if err != nil {
+		t.Fatalf("openPeerFile(%q) = %v", filePath, err)
+	}
+	content, _ := ioutil.ReadAll(file)
+	file.Close()
+	if string(content) != "content" || info.Size != 7 {
+		t.Errorf("openPeerFile(%q) read %q of %d bytes", filePath, content, info.Size)
+	}
+
+	if _, _, err := openPeerFile(blobPath(sha256Hash("missing"), "txt")); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("openPeerFile of a missing file = %v, want not found", err)
+	}
+	for _, filePath := range traversalPaths() {
+		if file, _, err := openPeerFile(filePath); err == nil {
+			file.Close()
+			t.Errorf("openPeerFile(%q) succeeded", filePath)
+		}
+	}
+}
+
+// Set for the test binary run by TestFileStoreLockAcrossProcesses, to the
+// store directory to hold the lock in
+const lockHolderEnv = "TEST_LOCK_HOLDER_DIR"
+
+// A record locked by another process can't be locked until it lets go
+func TestFileStoreLockAcrossProcesses(t *testing.T) {
+	filePath := indexJSONPath(sha256Hash("category"))
+	newStore := func(dir string) *FileStore {
+		return NewFileStore(filepath.Join(dir, UploadDirBase), filepath.Join(dir, OwnersDir), filepath.Join(dir, MetadataDir))
+	}
+
+	// The other process holds the lock until its standard input closes
+	if dir := os.Getenv(lockHolderEnv); dir != "" {
+		unlock, err := newStore(dir).Lock(filePath)
+		if err != nil {
+			fmt.Printf("error %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		io.Copy(ioutil.Discard, os.Stdin)
+		unlock()
+		os.Exit(0)
+	}
+	if !processFileLocks {
+		t.Skip("file locks don't exclude other processes on this system")
+	}
+
+	dir := t.TempDir()
+	holder := exec.Command(os.Args[0], "-test.run=^TestFileStoreLockAcrossProcesses$")
+	holder.Env = append(os.Environ(), lockHolderEnv+"="+dir)
+	release, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Wait()
+	defer release.Close()
+	if line, err := bufio.NewReader(output).ReadString('\n'); line != "locked\n" {
+		t.Fatalf("lock holder answered %q, %v", line, err)
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		unlock, err := newStore(dir).Lock(filePath)
+		if err == nil {
+			unlock()
+		}
+		locked <- err
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("Lock returned %v while another process held the lock", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	release.Close()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatalf("Lock after the other process let go: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Lock still waiting after the other process let go")
+	}
+}
+
+// Pages with markup injected through names are rendered again escaped, the
+// old page kept aside, and a dry run leaves everything as it was
+func TestRepairIndexes(t *testing.T) {
+	useMemoryStore(t)
+	fileHash := sha256Hash("content")
+	category, legacyCategory := sha256Hash("category"), sha256Hash("legacy category")
+	injected := "<script>alert(1)</script>"
+
+	index := Index{Hash: category, Entries: []IndexEntry{{FileHash: fileHash, Extension: "txt", Name: injected}}}
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPages := map[string]string{
+		category: `<a href="` + fileHash + `.txt">` + injected + `</a><br>`,
+		legacyCategory: `<a href="../../?reply=` + fileHash + `">[ Reply ]</a> <a href="../` + fileHash + `/index.html">[ Open ]</a> ` +
+			`<a href="` + fileHash + `.txt">` + injected + `</a><br>`,
+	}
+	if err := store.WriteFile(indexJSONPath(category), indexData); err != nil {
+		t.Fatal(err)
+	}
+	for hash, page := range oldPages {
+		if err := store.WriteFile(indexHTMLPath(hash), []byte(page)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RepairIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	for hash, oldPage := range oldPages {
+		if page, _ := store.ReadFile(indexHTMLPath(hash)); string(page) != oldPage {
+			t.Errorf("dry run changed %s", indexHTMLPath(hash))
+		}
+		if _, err := store.Stat(indexBackupPath(hash)); err == nil {
+			t.Errorf("dry run kept a backup of %s", indexHTMLPath(hash))
+		}
+	}
+	if _, err := store.Stat(indexJSONPath(legacyCategory)); err == nil {
+		t.Errorf("dry run wrote %s", indexJSONPath(legacyCategory))
+	}
+
+	if err := RepairIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	for hash, oldPage := range oldPages {
+		page, err := store.ReadFile(indexHTMLPath(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(page, []byte(injected)) || !bytes.Contains(page, []byte("&lt;script&gt;")) {
+			t.Errorf("%s not rendered escaped:\n%s", indexHTMLPath(hash), page)
+		}
+		if backup, _ := store.ReadFile(indexBackupPath(hash)); string(backup) != oldPage {
+			t.Errorf("backup of %s = %q, want the old page", indexHTMLPath(hash), backup)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package node
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Node of the reply graph, kept in data/<hash>/thread.json
+type ThreadNode struct {
+	Hash     string   `json:"hash"`
+	Parents  []string `json:"parents"`
+	Children []string `json:"children"`
+}
+
+// Content in a thread view
+type ThreadItem struct {
+	FileHash  string        `json:"file_hash"`
+	Extension string        `json:"extension,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Replies   []*ThreadItem `json:"replies,omitempty"`
+}
+
+// Thread returned by the JSON endpoint and rendered by the HTML page
+type ThreadResponse struct {
+	FileHash  string        `json:"file_hash"`
+	Ancestors []*ThreadItem `json:"ancestors"`
+	Tree      *ThreadItem   `json:"tree"`
+}
+
+// Limit on how deep thread views go
+const MaxThreadDepth = 64
+
+func threadPath(hash string) string {
+	return path.Join(UploadDirBase, hash, "thread.json")
+}
+
+// Load a node of the reply graph
+func loadThreadNode(hash string) (*ThreadNode, error) {
+	node := &ThreadNode{Hash: hash, Parents: []string{}, Children: []string{}}
+
+	nodeBytes, err := store.ReadFile(threadPath(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return node, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(nodeBytes, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func saveThreadNode(node *ThreadNode) error {
+	nodeBytes, err := json.MarshalIndent(node, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFile(threadPath(node.Hash), nodeBytes)
+}
+
+// Add a string to a list unless it is already there
+func appendUnique(list []string, value string) ([]string, bool) {
+	for _, existing := range list {
+		if existing == value {
+			return list, false
+		}
+	}
+	return append(list, value), true
+}
+
+// Update a node of the reply graph under its record lock, saving it when
+// the update reports a change. The lock is shared with other processes
+// using the same store.
+func updateThreadNode(hash string, update func(node *ThreadNode) bool) error {
+	unlock, err := lockRecord(threadPath(hash))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	node, err := loadThreadNode(hash)
+	if err != nil {
+		return err
+	}
+	if !update(node) {
+		return nil
+	}
+	return saveThreadNode(node)
+}
+
+// Record a reply in the graph
+func addReply(parentHash string, childHash string) error {
+	if parentHash == childHash {
+		return nil
+	}
+
+	err := updateThreadNode(parentHash, func(parent *ThreadNode) bool {
+		var added bool
+		parent.Children, added = appendUnique(parent.Children, childHash)
+		return added
+	})
+	if err != nil {
+		return err
+	}
+	return updateThreadNode(childHash, func(child *ThreadNode) bool {
+		var added bool
+		child.Parents, added = appendUnique(child.Parents, parentHash)
+		return added
+	})
+}
+
+// Merge the links of a peer's copy of a node into ours
+func mergeThreadNode(remote *ThreadNode) error {
+	return updateThreadNode(remote.Hash, func(node *ThreadNode) bool {
+		return mergeThreadLinks(node, remote)
+	})
+}
+
+// Add the valid links of a peer's copy of a node, reporting whether any
+// were missing. Peers may send hashes in uppercase, which are the same
+// content as ours.
+func mergeThreadLinks(node *ThreadNode, remote *ThreadNode) bool {
+	changed := false
+	for _, parent := range remote.Parents {
+		var added bool
+		parent = strings.ToLower(parent)
+		if IsValidSHA256(parent) && parent != node.Hash {
+			node.Parents, added = appendUnique(node.Parents, parent)
+			changed = changed || added
+		}
+	}
+	for _, child := range remote.Children {
+		var added bool
+		child = strings.ToLower(child)
+		if IsValidSHA256(child) && child != node.Hash {
+			node.Children, added = appendUnique(node.Children, child)
+			changed = changed || added
+		}
+	}
+	return changed
+}
+
+// Describe content using the entry in its own folder index
+func threadItem(hash string) *ThreadItem {
+	item := &ThreadItem{FileHash: hash}
+	if index, _, err := readIndex(hash); err == nil {
+		for _, entry := range index.Entries {
+			if entry.FileHash == hash {
+				item.Extension = entry.Extension
+				item.Name = entry.Name
+				break
+			}
+		}
+	}
+	return item
+}
+
+// Build the reply tree under some content
+func buildThreadTree(hash string, depth int, visited map[string]bool) *ThreadItem {
+	item := threadItem(hash)
+	if visited[hash] || depth >= MaxThreadDepth {
+		return item
+	}
+	visited[hash] = true
+
+	node, err := loadThreadNode(hash)
+	if err != nil {
+		return item
+	}
+	for _, child := range node.Children {
+		item.Replies = append(item.Replies, buildThreadTree(child, depth+1, visited))
+	}
+	return item
+}
+
+// List the ancestors of some content, root first, following first parents
+func threadAncestors(hash string) []*ThreadItem {
+	ancestors := []*ThreadItem{}
+	visited := map[string]bool{hash: true}
+
+	for len(ancestors) < MaxThreadDepth {
+		node, err := loadThreadNode(hash)
+		if err != nil || len(node.Parents) == 0 || visited[node.Parents[0]] {
+			break
+		}
+		hash = node.Parents[0]
+		visited[hash] = true
+		ancestors = append([]*ThreadItem{threadItem(hash)}, ancestors...)
+	}
+
+	return ancestors
+}
+
+// Build the full thread view of some content
+func buildThread(hash string) *ThreadResponse {
+	return &ThreadResponse{
+		FileHash:  hash,
+		Ancestors: threadAncestors(hash),
+		Tree:      buildThreadTree(hash, 0, map[string]bool{}),
+	}
+}
+
+var threadTemplate = template.Must(template.New("thread").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Thread {{.FileHash}}</title>
+    <link rel='stylesheet' href='/default.css'>
+    <style>
+        ul.thread { list-style: none; padding-left: 20px; border-left: 1px solid #ddd; }
+        .ancestors { margin-bottom: 20px; }
+    </style>
+</head>
+<body>
+    <p><a href="/">Home</a></p>
+    {{if .Ancestors}}
+    <div class="ancestors">
+        In reply to:
+        {{range .Ancestors}}<a href="/thread/{{.FileHash}}">{{template "name" .}}</a> &raquo; {{end}}
+    </div>
+    {{end}}
+    <ul class="thread">{{template "item" .Tree}}</ul>
+</body>
+</html>
+{{define "name"}}{{if .Name}}{{.Name}}{{else}}{{.FileHash}}{{end}}{{end}}
+{{define "item"}}<li>
+    <a href="/?reply={{.FileHash}}">[ Reply ]</a>
+    <a href="/thread/{{.FileHash}}">[ Thread ]</a>
+    {{if .Extension}}<a href="/data/{{.FileHash}}/{{.FileHash}}.{{.Extension}}">{{template "name" .}}</a>{{else}}{{template "name" .}}{{end}}
+    {{if .Replies}}<ul class="thread">{{range .Replies}}{{template "item" .}}{{end}}</ul>{{end}}
+</li>{{end}}`))
+
+// Handler for /thread/<hash>
+func threadHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/thread/"), "/"))
+	if !IsValidSHA256(hash) {
+		http.Error(w, "Invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	if err := threadTemplate.Execute(w, buildThread(hash)); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+// GET /api/v1/threads/{hash}
+func apiGetThread(w http.ResponseWriter, r *http.Request, hash string) {
+	if !IsValidSHA256(hash) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid hash")
+		return
+	}
+	writeJSON(w, http.StatusOK, buildThread(strings.ToLower(hash)))
+}
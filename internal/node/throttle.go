@@ -0,0 +1,154 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Sync concurrency and bandwidth settings
+const (
+	// Peers synced at the same time when the peers file doesn't say
+	DefaultMaxConcurrentSyncs = 4
+
+	// Largest read charged to a rate limiter at once
+	throttleChunk = 32 * 1024
+)
+
+var (
+	// Shared by every peer, so the limits hold however many syncs run
+	downloadLimiter = &rateLimiter{rate: func() int64 { return peersConfig.DownloadLimit }}
+	uploadLimiter   = &rateLimiter{rate: func() int64 { return peersConfig.UploadLimit }}
+
+	// Peers being synced, counted against the current setting
+	syncsRunning   int
+	syncSlotsMutex sync.Mutex
+	syncSlotsFreed = sync.NewCond(&syncSlotsMutex)
+)
+
+// Peers synced at the same time under the current setting
+func maxConcurrentSyncs() int {
+	if peersConfig.MaxConcurrentSyncs > 0 {
+		return peersConfig.MaxConcurrentSyncs
+	}
+	return DefaultMaxConcurrentSyncs
+}
+
+// Wait for a free sync slot. The returned function frees it. The limit is
+// read again each time a slot is freed, so a changed setting counts the
+// syncs already running.
+func acquireSyncSlot(ctx context.Context) (func(), error) {
+	// Wake the waiters when the context ends, for this one to give up
+	stop := context.AfterFunc(ctx, func() {
+		syncSlotsMutex.Lock()
+		defer syncSlotsMutex.Unlock()
+		syncSlotsFreed.Broadcast()
+	})
+	defer stop()
+
+	syncSlotsMutex.Lock()
+	defer syncSlotsMutex.Unlock()
+	for syncsRunning >= maxConcurrentSyncs() {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("Sync cancelled: %v", err)
+		}
+		syncSlotsFreed.Wait()
+	}
+	syncsRunning++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			syncSlotsMutex.Lock()
+			defer syncSlotsMutex.Unlock()
+			syncsRunning--
+			syncSlotsFreed.Broadcast()
+		})
+	}, nil
+}
+
+// Transfers kept in flight with a peer, within what a session serves
+func peerTransfers(peer Peer) int {
+	transfers := SessionPipelineDepth
+	if peer.Transfers > 0 {
+		transfers = peer.Transfers
+	} else if peersConfig.TransfersPerPeer > 0 {
+		transfers = peersConfig.TransfersPerPeer
+	}
+	if transfers > MaxSessionRequests {
+		transfers = MaxSessionRequests
+	}
+	return transfers
+}
+
+// Token bucket limiting bytes per second, holding up to one second of data
+type rateLimiter struct {
+	rate   func() int64 // Bytes per second, 0 for no limit
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Take n bytes from the bucket, waiting until they are available. Readers
+// waiting together are served in turn, as each one's debt delays the next.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	rate := float64(l.rate())
+	if rate <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader paced by a rate limiter
+type throttledReader struct {
+	ctx     context.Context
+	src     io.Reader
+	limiter *rateLimiter
+}
+
+// Pace a transfer, stopping it when the context is cancelled
+func throttle(ctx context.Context, src io.Reader, limiter *rateLimiter) io.Reader {
+	return &throttledReader{ctx: ctx, src: src, limiter: limiter}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.src.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A changed limit of concurrent syncs counts the syncs already running
+func TestSyncSlotsFollowSetting(t *testing.T) {
+	previous := peersConfig.MaxConcurrentSyncs
+	t.Cleanup(func() { peersConfig.MaxConcurrentSyncs = previous })
+
+	acquire := func() (func(), error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return acquireSyncSlot(ctx)
+	}
+
+	peersConfig.MaxConcurrentSyncs = 1
+	releaseOld, err := acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOld()
+	if _, err := acquire(); err == nil {
+		t.Fatal("second sync started with a limit of 1")
+	}
+
+	peersConfig.MaxConcurrentSyncs = 3
+	for i := 0; i < 2; i++ {
+		release, err := acquire()
+		if err != nil {
+			t.Fatalf("sync %d of 3: %v", i+2, err)
+		}
+		defer release()
+	}
+	if _, err := acquire(); err == nil {
+		t.Fatal("fourth sync started with a limit of 3")
+	}
+
+	// Freeing the slot taken under the old setting lets a waiting sync start
+	started := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		release, err := acquireSyncSlot(ctx)
+		if err == nil {
+			defer release()
+		}
+		started <- err
+	}()
+	releaseOld()
+	if err := <-started; err != nil {
+		t.Fatalf("sync after a slot was freed: %v", err)
+	}
+}
@@ -0,0 +1,1542 @@
+﻿package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Global configurations
+const (
+	// Store namespaces, the path layout shared with peers. The directories
+	// on disk default to the same names and are set in the config.
+	UploadDirBase = "data"
+	OwnersDir     = "owners"
+	MetadataDir   = "metadata"
+	
+	// Longest path accepted from a peer
+	MaxPeerPathLength = 4096
+	
+	// P2P protocol commands
+	CmdList     = byte(1)
+	CmdGetFile  = byte(2)
+	CmdPutFile  = byte(3)
+	CmdError    = byte(4)
+	CmdSuccess  = byte(5)
+	CmdManifest = byte(6)
+)
+
+// Metadata structure
+type Metadata struct {
+	User        string `json:"user"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+}
+
+// Upload received from the HTML form or the JSON API
+type UploadRequest struct {
+	Content          io.Reader
+	Size             int64
+	OriginalFileName string
+	FileExtension    string
+	TextContent      string
+	Category         string
+	BTC              string
+	Metadata         *Metadata
+	ReplyTo          string
+}
+
+// Saved upload locations
+type UploadResult struct {
+	FileHash      string `json:"file_hash"`
+	Extension     string `json:"extension"`
+	ContentType   string `json:"content_type"`
+	CategoryHash  string `json:"category_hash"`
+	FilePath      string `json:"file_path"`
+	FileIndex     string `json:"file_index"`
+	CategoryIndex string `json:"category_index"`
+}
+
+// Upload error with the HTTP status to report
+type UploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *UploadError) Error() string {
+	return e.Message
+}
+
+// P2P sync result structure
+type SyncResult struct {
+	Server      string   `json:"server"`
+	Status      string   `json:"status"`
+	Downloaded  []string `json:"downloaded"`
+	Uploaded    []string `json:"uploaded"`
+	Errors      []string `json:"errors"`
+	Skipped     int      `json:"skipped"`
+	BytesSaved  int64    `json:"bytes_saved"`
+	ElapsedTime string   `json:"elapsed_time"`
+}
+
+// Calculate SHA-256 hash
+func calculateSHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Check if a string is a valid SHA-256 hash
+func IsValidSHA256(input string) bool {
+	matched, _ := regexp.MatchString(`^[a-fA-F0-9]{64}$`, input)
+	return matched
+}
+
+// Check and process SHA-256 hash
+func CheckSHA256(input string) string {
+	if IsValidSHA256(input) {
+		return strings.ToLower(input)
+	}
+	hash := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(hash[:])
+}
+
+// Create directories if they don't exist
+func ensureDirectoriesExist() {
+	dirs := []string{config.DataDir, config.OwnersDir, config.MetadataDir}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			os.MkdirAll(dir, 0777)
+		}
+	}
+}
+
+// Save file using hash pattern
+func saveFileWithHashPattern(src io.Reader, fileExtension string, originalFileName string, category string, btcInfo string, metadata *Metadata, replyTo string, contentType string) (string, string, error) {
+	// Store the content, calculating its hash while streaming. Staged
+	// content was hashed on the way in and only needs moving into place.
+	var fileHash string
+	var err error
+	if staged, ok := src.(StagedContent); ok {
+		fileHash, err = staged.Hash(), staged.Commit(fileExtension)
+	} else {
+		fileHash, _, err = store.Put(src, fileExtension)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	categoryHash := CheckSHA256(category)
+	
+	fileNameWithExtension := fileHash + "." + fileExtension
+	
+	// Save BTC info if provided
+	if btcInfo != "" {
+		store.PutOwner(fileHash, btcInfo)
+	}
+	
+	// Save metadata if provided
+	if metadata != nil && metadata.User != "" && metadata.Title != "" && metadata.Description != "" && metadata.URL != "" {
+		store.PutMetadata(fileHash, metadata)
+	}
+	
+	// Create empty file in category folder with hash + extension name. A
+	// category named after the content is the content's own folder, which
+	// already holds it.
+	if categoryHash != fileHash {
+		if err := store.Link(categoryHash, fileNameWithExtension); err != nil {
+			return "", "", err
+		}
+	}
+	
+	// List the content in its own folder index and in the category index
+	entry := IndexEntry{
+		FileHash:    fileHash,
+		Extension:   fileExtension,
+		Name:        originalFileName,
+		Time:        time.Now(),
+		ReplyTo:     replyTo,
+		ContentType: contentType,
+	}
+	if err := addIndexEntry(fileHash, entry); err != nil {
+		return "", "", fmt.Errorf("Error updating index: %v", err)
+	}
+	if err := addIndexEntry(categoryHash, entry); err != nil {
+		return "", "", fmt.Errorf("Error updating category index: %v", err)
+	}
+	
+	// Record the reply in the thread graph
+	if replyTo != "" {
+		if err := addReply(replyTo, fileHash); err != nil {
+			return "", "", fmt.Errorf("Error updating thread: %v", err)
+		}
+	}
+	
+	// Make the content searchable
+	searchCategory := categoryHash
+	if searchCategory == fileHash {
+		searchCategory = ""
+	}
+	if err := searchIndex.Add(entry, searchCategory, loadMetadata(fileHash)); err != nil {
+		log.Printf("Error updating search index: %v", err)
+	}
+	
+	indexPathCategoryFolder := indexHTMLPath(categoryHash)
+	return fileHash, indexPathCategoryFolder, nil
+}
+
+// sha256Hash generates SHA-256 hash for a message
+func sha256Hash(message string) string {
+	hash := sha256.Sum256([]byte(message))
+	return hex.EncodeToString(hash[:])
+}
+
+// Handler for search
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	searchInput := strings.TrimSpace(r.URL.Query().Get("search-input"))
+	if searchInput == "" {
+		return
+	}
+	
+	// Input may be a hash or the text of a category
+	hash := CheckSHA256(searchInput)
+	
+	// Go straight to the page when it exists
+	if _, err := store.Stat(indexHTMLPath(hash)); err == nil {
+		http.Redirect(w, r, "/"+indexHTMLPath(hash), http.StatusFound)
+		return
+	}
+	
+	// Otherwise look it up in the search index
+	http.Redirect(w, r, "/search?q="+url.QueryEscape(searchInput), http.StatusFound)
+}
+
+// Handler for upload and P2P
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		// Ensure directories exist
+		ensureDirectoriesExist()
+		
+		// Read the form within the size limits, without holding the
+		// content in memory
+		file, err := readUploadRequest(w, r, "uploaded_file")
+		if err != nil {
+			w.WriteHeader(uploadErrorStatus(err))
+			fmt.Fprintf(w, "<p class='error'>%s</p>", template.HTMLEscapeString(err.Error()))
+			renderMainPage(w, r, "", nil)
+			return
+		}
+		if file != nil {
+			defer file.Remove()
+		}
+		
+		// Check if it's a P2P sync
+		if r.FormValue("p2p_sync") == "true" {
+			handleP2PSync(w, r)
+			return
+		}
+		
+		upload := &UploadRequest{
+			Category:    r.FormValue("category"),
+			TextContent: r.FormValue("text_content"),
+			BTC:         r.FormValue("btc"),
+			ReplyTo:     r.FormValue("reply"),
+			Metadata: &Metadata{
+				User:        r.FormValue("user"),
+				Title:       r.FormValue("title"),
+				Description: r.FormValue("description"),
+				URL:         r.FormValue("url"),
+			},
+		}
+		
+		// Check if a file was uploaded
+		if file != nil {
+			upload.Content = file
+			upload.Size = file.Size()
+			upload.OriginalFileName = file.FileName
+		}
+		
+		// Save the file with hash pattern
+		uploadResult, err := ProcessUpload(upload)
+		if err != nil {
+			w.WriteHeader(uploadErrorStatus(err))
+			// Errors may quote the file name sent
+			fmt.Fprintf(w, "<p class='error'>%s</p>", template.HTMLEscapeString(err.Error()))
+			renderMainPage(w, r, "", nil)
+			return
+		}
+		
+		// Display success message
+		fmt.Fprintf(w, "<p class='success'>Content processed successfully!</p>")
+		fmt.Fprintf(w, "<p>Content saved in: <pre><a href='/%s'>%s</a></pre></p>",
+			template.HTMLEscapeString(uploadResult.CategoryIndex),
+			template.HTMLEscapeString(uploadResult.CategoryIndex))
+		
+		renderMainPage(w, r, "", nil)
+	} else {
+		// If not POST, render main page
+		reply := r.URL.Query().Get("reply")
+		renderMainPage(w, r, reply, nil)
+	}
+}
+
+// Validate an upload and save it with hash pattern
+func ProcessUpload(upload *UploadRequest) (*UploadResult, error) {
+	// Replies go into the category of the content they answer
+	if upload.ReplyTo != "" {
+		// Hashes are stored lowercase, as category hashes are
+		upload.ReplyTo = strings.ToLower(upload.ReplyTo)
+		if !IsValidSHA256(upload.ReplyTo) {
+			return nil, &UploadError{http.StatusBadRequest, "Error: Invalid reply hash."}
+		}
+		if upload.Category == "" {
+			upload.Category = upload.ReplyTo
+		}
+	}
+	
+	// Check if category was provided
+	if upload.Category == "" {
+		return nil, &UploadError{http.StatusBadRequest, "Please select a file or enter text content and provide a category."}
+	}
+	
+	fileExtension := upload.FileExtension
+	originalFileName := upload.OriginalFileName
+	
+	if upload.Content != nil {
+		if fileExtension == "" {
+			fileExtension = filepath.Ext(originalFileName)
+			if fileExtension != "" {
+				fileExtension = fileExtension[1:] // Remove leading dot
+			}
+		}
+	} else if upload.TextContent != "" {
+		// If no file, use the text content
+		upload.Content = strings.NewReader(upload.TextContent)
+		upload.Size = int64(len(upload.TextContent))
+		date := time.Now().Format("2006.01.02 15:04:05")
+		
+		if len(upload.TextContent) > 50 {
+			originalFileName = upload.TextContent[:50] + " (" + date + ")"
+		} else {
+			originalFileName = upload.TextContent + " (" + date + ")"
+		}
+		
+		fileExtension = "txt"
+	} else {
+		return nil, &UploadError{http.StatusBadRequest, "Please select a file or enter text content."}
+	}
+	
+	// Check if there's content to process
+	if upload.Size == 0 {
+		return nil, &UploadError{http.StatusBadRequest, "No content to process."}
+	}
+	
+	// Check the size limit of the category, also while saving as the size
+	// of streamed content isn't known in advance
+	limit := uploadLimit(CheckSHA256(upload.Category))
+	if limit > 0 && upload.Size > limit {
+		return nil, uploadTooLarge(limit)
+	}
+	
+	// Detect the content type from the first bytes, name the file after it
+	// and check the content policy (PHP is blocked by default)
+	head := make([]byte, sniffLength)
+	headSize, err := io.ReadFull(upload.Content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		if isBodyTooLarge(err) {
+			return nil, uploadTooLarge(limit)
+		}
+		return nil, &UploadError{http.StatusBadRequest, fmt.Sprintf("Error reading content: %v", err)}
+	}
+	if headSize == 0 {
+		return nil, &UploadError{http.StatusBadRequest, "No content to process."}
+	}
+	head = head[:headSize]
+	contentType := detectContentType(head)
+	sentExtension := fileExtension
+	fileExtension = contentExtension(sentExtension, contentType)
+	if err := checkContentPolicy(sentExtension, fileExtension, contentType); err != nil {
+		return nil, err
+	}
+	
+	content := io.MultiReader(bytes.NewReader(head), upload.Content)
+	var limited *limitedUpload
+	if staged, ok := upload.Content.(StagedContent); ok {
+		// Staged content is in the store already, its size checked above
+		content = staged
+	} else if limit > 0 {
+		limited = &limitedUpload{src: content, remaining: limit}
+		content = limited
+	}
+	
+	// Check if category is the same as text content
+	if upload.Category == upload.TextContent {
+		return nil, &UploadError{http.StatusUnprocessableEntity, "Error: Category can't be the same of text contents."}
+	}
+	
+	fileHash, indexPathCategoryFolder, err := saveFileWithHashPattern(
+		content,
+		fileExtension,
+		originalFileName,
+		upload.Category,
+		upload.BTC,
+		upload.Metadata,
+		upload.ReplyTo,
+		contentType,
+	)
+	if limited != nil && limited.exceeded {
+		return nil, uploadTooLarge(limit)
+	}
+	if err != nil {
+		return nil, &UploadError{http.StatusInternalServerError, err.Error()}
+	}
+	
+	return &UploadResult{
+		FileHash:      fileHash,
+		Extension:     fileExtension,
+		ContentType:   contentType,
+		CategoryHash:  CheckSHA256(upload.Category),
+		FilePath:      blobPath(fileHash, fileExtension),
+		FileIndex:     indexHTMLPath(fileHash),
+		CategoryIndex: indexPathCategoryFolder,
+	}, nil
+}
+
+// Handler for P2P sync
+func handleP2PSync(w http.ResponseWriter, r *http.Request) {
+	serversText := r.FormValue("servers")
+	// Removida a verificação do checkbox "allow_send_files"
+	// Agora sempre fará upload e download
+	servers := strings.Split(serversText, "\n")
+	
+	// Closing the page cancels the sync
+	results := SyncPeerLines(r.Context(), servers)
+	
+	// Render main page with results
+	renderMainPage(w, r, "", results)
+}
+
+// Sync with the peers of sync form lines, reporting the lines that don't
+// parse as failed syncs
+func SyncPeerLines(ctx context.Context, lines []string) []SyncResult {
+	var results []SyncResult
+	var peers []Peer
+	
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		
+		// Each line may carry TLS and authentication options
+		peer, err := parsePeerLine(line)
+		if err != nil {
+			results = append(results, SyncResult{
+				Server: line,
+				Status: "error",
+				Errors: []string{err.Error()},
+			})
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	
+	return append(results, SyncPeers(ctx, peers)...)
+}
+
+// Sync with peers at the same time, uploading and downloading, and record
+// the results as manual syncs
+func SyncPeers(ctx context.Context, peers []Peer) []SyncResult {
+	results := make([]SyncResult, len(peers))
+	var wg sync.WaitGroup
+	
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer Peer) {
+			defer wg.Done()
+			results[i] = p2pSyncWithServer(ctx, peer, true)
+			syncState.Record("manual", results[i], 0)
+		}(i, peer)
+	}
+	
+	wg.Wait()
+	return results
+}
+
+// Render main page
+func renderMainPage(w http.ResponseWriter, r *http.Request, reply string, p2pResults []SyncResult) {
+	htmlTemplate := `<!DOCTYPE html>
+<html>
+<head>
+    <title>File/Text Upload with Category and P2P</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+        }
+
+        body {
+            max-width: 800px;
+            margin: 40px auto;
+            padding: 0 20px;
+            color: #333;
+            line-height: 1.6;
+        }
+
+        h2, h3 {
+            font-size: 1.5em;
+            margin-bottom: 20px;
+            color: #222;
+        }
+
+        form {
+            display: flex;
+            flex-direction: column;
+            gap: 15px;
+            margin-bottom: 30px;
+        }
+
+        label {
+            font-size: 0.9em;
+            color: #444;
+        }
+
+        input[type="text"],
+        input[type="url"],
+        textarea,
+        input[type="file"] {
+            width: 100%;
+            padding: 10px;
+            border: 1px solid #ddd;
+            border-radius: 5px;
+            font-size: 1em;
+            transition: border-color 0.2s;
+        }
+
+        input[type="text"]:focus,
+        input[type="url"]:focus,
+        textarea:focus {
+            outline: none;
+            border-color: #4a90e2;
+        }
+
+        textarea {
+            resize: vertical;
+            min-height: 100px;
+        }
+
+        button, input[type="submit"] {
+            padding: 10px 20px;
+            background: #4a90e2;
+            color: white;
+            border: none;
+            border-radius: 5px;
+            font-size: 1em;
+            cursor: pointer;
+            transition: background 0.2s;
+        }
+
+        button:hover, input[type="submit"]:hover {
+            background: #357abd;
+        }
+
+        .search-form {
+            flex-direction: row;
+            gap: 10px;
+            margin-bottom: 30px;
+        }
+
+        .search-form input {
+            flex: 1;
+        }
+
+        .more-options-link {
+            color: #4a90e2;
+            font-size: 0.9em;
+            cursor: pointer;
+            text-decoration: none;
+            margin: 10px 0;
+            display: inline-block;
+        }
+
+        .more-options-link:hover {
+            text-decoration: underline;
+        }
+
+        .optional-fields {
+            display: none;
+            padding: 15px;
+            background: #f8f9fa;
+            border-radius: 5px;
+        }
+
+        .success {
+            color: #2ecc71;
+            font-size: 0.9em;
+        }
+
+        .error {
+            color: #e74c3c;
+            font-size: 0.9em;
+        }
+
+        .section-divider {
+            border-top: 1px solid #ddd;
+            margin: 30px 0;
+            padding-top: 20px;
+        }
+
+        .checkbox-container {
+            display: flex;
+            align-items: center;
+            gap: 10px;
+            margin: 10px 0;
+        }
+
+        .checkbox-container input[type="checkbox"] {
+            width: 18px;
+            height: 18px;
+        }
+
+        .mode-description {
+            font-size: 0.85em;
+            color: #666;
+            margin-top: 5px;
+            margin-left: 28px;
+        }
+
+        .results {
+            margin-top: 30px;
+        }
+
+        .result-card {
+            background: #f8f9fa;
+            border-radius: 5px;
+            padding: 15px;
+            margin-bottom: 20px;
+            border-left: 4px solid #4a90e2;
+        }
+
+        .result-card.error {
+            border-left-color: #e74c3c;
+        }
+
+        .result-card h3 {
+            margin-bottom: 10px;
+            display: flex;
+            justify-content: space-between;
+        }
+
+        .result-card .status {
+            font-size: 0.8em;
+            padding: 3px 8px;
+            border-radius: 3px;
+            color: white;
+        }
+
+        .result-card .status.success {
+            background: #2ecc71;
+        }
+
+        .result-card .status.error {
+            background: #e74c3c;
+        }
+
+        .file-list {
+            margin: 10px 0;
+            padding-left: 20px;
+        }
+
+        .file-list li {
+            font-size: 0.9em;
+            margin-bottom: 5px;
+            word-break: break-all;
+        }
+
+        .error-list {
+            color: #e74c3c;
+        }
+
+        .time {
+            font-size: 0.8em;
+            color: #666;
+            margin-top: 10px;
+            text-align: right;
+        }
+
+        .empty-message {
+            color: #666;
+            font-style: italic;
+        }
+
+        .section-title {
+            font-size: 1em;
+            margin: 15px 0 5px 0;
+            color: #555;
+        }
+    </style>
+    <script>
+        document.addEventListener('DOMContentLoaded', () => {
+            const moreOptionsLink = document.getElementById('more-options-link');
+            const optionalFields = document.getElementById('optional-fields');
+
+            moreOptionsLink.addEventListener('click', () => {
+                const isHidden = optionalFields.style.display === 'none' || optionalFields.style.display === '';
+                optionalFields.style.display = isHidden ? 'block' : 'none';
+                moreOptionsLink.textContent = isHidden ? 'Less options' : 'More options';
+            });
+        });
+    </script>
+</head>
+<body>
+    <form method="GET" action="/" id="search-form" class="search-form">
+        <input type="text" id="search" name="search-input" placeholder="Enter file hash or category" required>
+        <button type="submit">Search</button>
+    </form>
+
+    <h2>Upload File</h2>
+
+    <form action="/" method="post" enctype="multipart/form-data">
+        <label for="uploaded_file">Select File:</label>
+        <input type="file" name="uploaded_file" id="uploaded_file">
+
+        <label for="text_content">Or enter text content:</label>
+        <textarea name="text_content" id="text_content" rows="5"></textarea>
+
+        <label for="category">Category:</label>
+        <input type="text" name="category" id="category" value="{{.Reply}}" required {{if .Reply}}readonly{{end}}>
+        {{if .Reply}}<input type="hidden" name="reply" value="{{.Reply}}">
+        <a href="/thread/{{.Reply}}">View thread</a>{{end}}
+
+        <a id="more-options-link" class="more-options-link">More options</a>
+        
+        <div id="optional-fields" class="optional-fields">
+            <label for="btc">BTC/PIX (optional):</label>
+            <input type="text" name="btc" id="btc" placeholder="BTC address">
+            
+            <label for="user">User (optional):</label>
+            <input type="text" name="user" id="user" placeholder="Username">
+            
+            <label for="title">Title (optional):</label>
+            <input type="text" name="title" id="title" placeholder="Content title">
+            
+            <label for="description">Description (optional):</label>
+            <input type="text" name="description" id="description" placeholder="Content description">
+            
+            <label for="url">URL (optional):</label>
+            <input type="url" name="url" id="url" placeholder="Related URL">
+        </div>
+
+        <input type="submit" value="Upload">
+    </form>
+
+    <div class="section-divider"></div>
+
+    <h2>P2P Synchronization</h2>
+    
+    <form action="/" method="post" enctype="multipart/form-data">
+        <input type="hidden" name="p2p_sync" value="true">
+        
+        <label for="servers">Server List (one per line, format: host:port [tls] [fingerprint=sha256] [psk=key]):</label>
+        <textarea name="servers" id="servers" rows="5" placeholder="example1.com:8081&#10;example2.com:8081 tls fingerprint=...&#10;192.168.1.100:8081 psk=...">{{.ServersText}}</textarea>
+        
+        {{if .Fingerprint}}
+        <div class="mode-description">
+            Certificate fingerprint of this node: <code>{{.Fingerprint}}</code>
+        </div>
+        {{end}}
+        
+        <!-- Checkbox "Allow sending files" removido conforme solicitado -->
+        <div class="mode-description">
+            O cliente enviará arquivos locais para os servidores e baixará todos os arquivos dos servidores.
+        </div>
+        
+        <input type="submit" value="Synchronize">
+    </form>
+    
+    <p><a href="/sync">Scheduled sync status and history</a></p>
+
+    {{if .P2PResults}}
+    <div class="results">
+        <h3>Synchronization Results</h3>
+        
+        {{range .P2PResults}}
+        <div class="result-card {{if eq .Status "error"}}error{{end}}">
+            <h3>
+                {{.Server}}
+                <span class="status {{.Status}}">{{.Status}}</span>
+            </h3>
+            
+            {{if .Downloaded}}
+            <div class="section-title">Downloaded Files:</div>
+            <ul class="file-list">
+                {{range .Downloaded}}
+                <li>{{.}}</li>
+                {{end}}
+            </ul>
+            {{else}}
+            <div class="section-title">Downloaded Files:</div>
+            <p class="empty-message">No files downloaded</p>
+            {{end}}
+            
+            {{if .Uploaded}}
+            <div class="section-title">Uploaded Files:</div>
+            <ul class="file-list">
+                {{range .Uploaded}}
+                <li>{{.}}</li>
+                {{end}}
+            </ul>
+            {{else}}
+            <div class="section-title">Uploaded Files:</div>
+            <p class="empty-message">No files uploaded</p>
+            {{end}}
+            
+            {{if .Errors}}
+            <div class="section-title">Errors:</div>
+            <ul class="file-list error-list">
+                {{range .Errors}}
+                <li>{{.}}</li>
+                {{end}}
+            </ul>
+            {{end}}
+            
+            {{if .Skipped}}
+            <div class="section-title">Skipped {{.Skipped}} unchanged file(s), {{.BytesSaved}} bytes saved</div>
+            {{end}}
+            
+            <div class="time">Time: {{.ElapsedTime}}</div>
+        </div>
+        {{end}}
+    </div>
+    {{end}}
+</body>
+</html>`
+
+	tmpl, err := template.New("index").Parse(htmlTemplate)
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Reply          string
+		ServersText    string
+		Fingerprint    string
+		P2PResults     []SyncResult
+	}{
+		Reply:          reply,
+		ServersText:    "",
+		Fingerprint:    p2pFingerprint,
+		P2PResults:     p2pResults,
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// Sync with a P2P server
+func p2pSyncWithServer(ctx context.Context, peer Peer, allowSendFiles bool) SyncResult {
+	result := SyncResult{
+		Server:     peer.Address,
+		Status:     "error",
+		Downloaded: []string{},
+		Uploaded:   []string{},
+		Errors:     []string{},
+	}
+	
+	// Only a few peers are synced at once, the rest wait their turn
+	release, err := acquireSyncSlot(ctx)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	defer release()
+	
+	startTime := time.Now()
+	
+	// One session carries every request to this server
+	session, err := dialPeer(ctx, peer)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		result.ElapsedTime = time.Since(startTime).String()
+		return result
+	}
+	defer session.Close()
+	
+	// Cancelling the sync closes the session, aborting transfers in flight
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-finished:
+		}
+	}()
+	
+	// Trade known peers, so nodes learn about each other
+	if peersConfig.Gossip {
+		if err := gossipWithPeer(session, peer); err == errPeerIsSelf {
+			result.Errors = append(result.Errors, err.Error())
+			result.ElapsedTime = time.Since(startTime).String()
+			return result
+		} else if err != nil {
+			log.Printf("Peer exchange with %s failed: %v", peer.Address, err)
+		}
+	}
+	
+	// Ask the server what it has, falling back to a plain list on older servers
+	serverManifest, err := session.Manifest()
+	if err != nil {
+		serverFiles, listErr := session.List()
+		if listErr != nil {
+			result.Errors = append(result.Errors, listErr.Error())
+			result.ElapsedTime = time.Since(startTime).String()
+			return result
+		}
+		
+		serverManifest = nil
+		for _, filePath := range serverFiles {
+			if filePath != "" {
+				serverManifest = append(serverManifest, ManifestEntry{Path: filePath})
+			}
+		}
+	}
+	
+	// Describe local files before anything is transferred
+	localManifest, err := buildManifest()
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("Error listing local files: %v", err))
+	}
+	serverEntries := make(map[string]ManifestEntry, len(serverManifest))
+	for _, entry := range serverManifest {
+		serverEntries[entry.Path] = entry
+	}
+	plan := planSync(serverManifest, localManifest)
+	result.Skipped = plan.Skipped
+	result.BytesSaved = plan.BytesSaved
+	
+	// Transfers run concurrently on the session
+	var resultMutex sync.Mutex
+	
+	// Download what we don't have, and indexes and threads to merge
+	downloads := plan.Downloads
+	transfers := peerTransfers(peer)
+	pipelined(ctx, transfers, downloads, func(filePath string) {
+		downloadErr := downloadFile(ctx, session, serverEntries[filePath])
+		
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		if downloadErr != nil {
+			result.Errors = append(result.Errors, downloadErr.Error())
+			return
+		}
+		result.Downloaded = append(result.Downloaded, filePath)
+	})
+	if ctx.Err() != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("Sync cancelled: %v", ctx.Err()))
+		result.ElapsedTime = time.Since(startTime).String()
+		return result
+	}
+	
+	// Upload what the server doesn't have, and indexes and threads to merge
+	uploads := plan.Uploads
+	pipelined(ctx, transfers, uploads, func(filePath string) {
+		uploadErr := uploadFile(ctx, session, filePath)
+		
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		if uploadErr != nil {
+			result.Errors = append(result.Errors, uploadErr.Error())
+			return
+		}
+		result.Uploaded = append(result.Uploaded, filePath)
+	})
+	if ctx.Err() != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("Sync cancelled: %v", ctx.Err()))
+		result.ElapsedTime = time.Since(startTime).String()
+		return result
+	}
+	
+	result.Status = "success"
+	result.ElapsedTime = time.Since(startTime).String()
+	return result
+}
+
+// Download a file from the server
+func downloadFile(ctx context.Context, session *Session, entry ManifestEntry) error {
+    filePath := entry.Path
+    
+    // Large files are resumed from what earlier attempts received
+    if entry.SHA256 != "" && entry.Size >= ResumableTransferSize {
+        return resumeDownload(ctx, session, entry)
+    }
+    
+    // Request the file
+    stream, header, err := session.Get(filePath)
+    if err != nil {
+        return fmt.Errorf("Error downloading %s: %v", filePath, err)
+    }
+    defer stream.Close()
+    
+    // Store the record at the same path it has on the server, once verified
+    if err := receiveRecord(filePath, throttle(ctx, stream, downloadLimiter), header.Size, header.SHA256); err != nil {
+        return fmt.Errorf("Error saving downloaded file %s: %v", filePath, err)
+    }
+    
+    return nil
+}
+
+// Download a large file through its partial file
+func resumeDownload(ctx context.Context, session *Session, entry ManifestEntry) error {
+	unlock, err := lockPartial(entry.SHA256)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	
+	offset := partialSize(entry.SHA256)
+	if offset > entry.Size {
+		removePartial(entry.SHA256)
+		offset = 0
+	}
+	
+	// Fetch the missing range
+	if offset < entry.Size {
+		stream, header, err := session.GetRange(entry.Path, offset, 0)
+		if err != nil {
+			return fmt.Errorf("Error downloading %s: %v", entry.Path, err)
+		}
+		defer stream.Close()
+		
+		if header.SHA256 != entry.SHA256 || header.Size != entry.Size {
+			removePartial(entry.SHA256)
+			return fmt.Errorf("Error downloading %s: file changed on the server", entry.Path)
+		}
+		if err := appendPartial(entry.SHA256, offset, throttle(ctx, stream, downloadLimiter)); err != nil {
+			return fmt.Errorf("Error downloading %s after %d bytes: %v", entry.Path, partialSize(entry.SHA256), err)
+		}
+	}
+	
+	// Store the record at the same path it has on the server, once verified
+	if err := commitPartial(entry.Path, entry.SHA256, entry.Size); err != nil {
+		return fmt.Errorf("Error saving downloaded file %s: %v", entry.Path, err)
+	}
+	return nil
+}
+
+// Upload a file to the server
+func uploadFile(ctx context.Context, session *Session, filePath string) error {
+	// Get file size and hash for the server to verify
+	entry, err := manifestEntry(filePath)
+	if err != nil {
+		return fmt.Errorf("Error getting file info for %s: %v", filePath, err)
+	}
+	
+	// Open file for reading
+	file, err := store.Get(filePath)
+	if err != nil {
+		return fmt.Errorf("Error opening file %s for upload: %v", filePath, err)
+	}
+	defer file.Close()
+	
+	// Resume large uploads where the server's partial file stops
+	header := TransferHeader{Path: filePath, Size: entry.Size, SHA256: entry.SHA256}
+	if entry.Size >= ResumableTransferSize {
+		offset, err := session.QueryOffset(filePath, entry.Size, entry.SHA256)
+		if err == nil && offset > 0 && offset <= entry.Size {
+			if _, err := file.Seek(offset, io.SeekStart); err == nil {
+				header.Offset = offset
+			}
+		}
+	}
+	
+	// Send the file and wait for the server to store it
+	_, err = session.Put(header, throttle(ctx, file, uploadLimiter))
+	if err != nil {
+		return fmt.Errorf("Error uploading %s: %v", filePath, err)
+	}
+	
+	return nil
+}
+
+// Handle P2P connections
+func handleP2PConnection(rawConn net.Conn) {
+	defer rawConn.Close()
+	
+	// Stalled peers are dropped instead of holding the connection forever
+	limits := p2pLimits()
+	rawConn = &deadlineConn{Conn: rawConn, readTimeout: limits.ReadTimeout, writeTimeout: limits.WriteTimeout}
+	
+	// Negotiate TLS and identify the peer
+	conn, peerName, err := acceptP2PConnection(rawConn)
+	if err != nil {
+		log.Printf("Error accepting P2P connection: %v", err)
+		return
+	}
+	
+	// Read command
+	cmdBuffer := make([]byte, 1)
+	_, err = io.ReadFull(conn, cmdBuffer)
+	if err != nil {
+		log.Printf("Error reading P2P command: %v", err)
+		return
+	}
+	
+	cmd := cmdBuffer[0]
+	
+	// Peers speaking the session protocol open with its handshake
+	if cmd == SessionMagic[0] {
+		serveSession(conn, peerName)
+		return
+	}
+	
+	// Single commands can't authenticate with a pre-shared key
+	if peersConfig.RequireKnownPeers && peerName == "" {
+		log.Printf("Refused P2P command from unknown peer %s", conn.RemoteAddr())
+		return
+	}
+	
+	switch cmd {
+	case CmdList:
+		// List files in data_tmp, metadata and owners folders
+		fileList, _ := store.List()
+		fileListStr := strings.Join(fileList, "\n")
+		
+		// Send list size
+		sizeBuffer := make([]byte, 4)
+		binary.BigEndian.PutUint32(sizeBuffer, uint32(len(fileListStr)))
+		conn.Write(sizeBuffer)
+		
+		// Send list
+		conn.Write([]byte(fileListStr))
+		
+	case CmdManifest:
+		// Describe every stored file so peers only fetch what they lack
+		manifest, _ := buildManifest()
+		if manifest == nil {
+			manifest = []ManifestEntry{}
+		}
+		manifestBytes, _ := json.Marshal(manifest)
+		
+		// Send manifest size
+		sizeBuffer := make([]byte, 4)
+		binary.BigEndian.PutUint32(sizeBuffer, uint32(len(manifestBytes)))
+		conn.Write(sizeBuffer)
+		
+		// Send manifest
+		conn.Write(manifestBytes)
+		
+	case CmdGetFile:
+		// Read path size
+		pathSizeBuffer := make([]byte, 4)
+		_, err := io.ReadFull(conn, pathSizeBuffer)
+		if err != nil {
+			log.Printf("Error reading path size: %v", err)
+			return
+		}
+		
+		pathSize := binary.BigEndian.Uint32(pathSizeBuffer)
+		if pathSize > uint32(limits.MaxPathLength) {
+			writeP2PError(conn, "Path too long")
+			return
+		}
+		
+		// Read path
+		pathBuffer := make([]byte, pathSize)
+		_, err = io.ReadFull(conn, pathBuffer)
+		if err != nil {
+			log.Printf("Error reading file path: %v", err)
+			return
+		}
+		
+		filePath := string(pathBuffer)
+		
+		// Open file, refusing paths outside the store
+		file, fileInfo, err := openPeerFile(filePath)
+		if err != nil {
+			writeP2PError(conn, err.Error())
+			return
+		}
+		defer file.Close()
+		
+		// Send success
+		conn.Write([]byte{CmdSuccess})
+		
+		// Send file size
+		fileSizeBuffer := make([]byte, 8)
+		binary.BigEndian.PutUint64(fileSizeBuffer, uint64(fileInfo.Size))
+		conn.Write(fileSizeBuffer)
+		
+		// Send file in blocks
+		buffer := make([]byte, config.BufferSize)
+		for {
+			n, err := file.Read(buffer)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				log.Printf("Error reading file %s: %v", filePath, err)
+				return
+			}
+			
+			_, err = conn.Write(buffer[:n])
+			if err != nil {
+				log.Printf("Error sending file data for %s: %v", filePath, err)
+				return
+			}
+		}
+		
+	case CmdPutFile:
+		// Removida a verificação de AllowSendFiles
+		// Agora sempre aceita arquivos
+		
+		// Read path size
+		pathSizeBuffer := make([]byte, 4)
+		_, err := io.ReadFull(conn, pathSizeBuffer)
+		if err != nil {
+			log.Printf("Error reading path size: %v", err)
+			return
+		}
+		
+		pathSize := binary.BigEndian.Uint32(pathSizeBuffer)
+		if pathSize > uint32(limits.MaxPathLength) {
+			writeP2PError(conn, "Path too long")
+			return
+		}
+		
+		// Read path
+		pathBuffer := make([]byte, pathSize)
+		_, err = io.ReadFull(conn, pathBuffer)
+		if err != nil {
+			log.Printf("Error reading file path: %v", err)
+			return
+		}
+		
+		filePath := string(pathBuffer)
+		
+		// Read file size
+		fileSizeBuffer := make([]byte, 8)
+		_, err = io.ReadFull(conn, fileSizeBuffer)
+		if err != nil {
+			log.Printf("Error reading file size: %v", err)
+			return
+		}
+		
+		fileSize := binary.BigEndian.Uint64(fileSizeBuffer)
+		if fileSize > uint64(limits.MaxFileSize) {
+			writeP2PError(conn, fmt.Sprintf("File too large: %d bytes, the limit is %d", fileSize, limits.MaxFileSize))
+			return
+		}
+		
+		// Check if file already exists
+		//if _, err := os.Stat(filePath); err == nil {
+			// Send error
+			//conn.Write([]byte{CmdError})
+			//errorMsg := "File already exists"
+			
+			// Send error message size
+			//errSizeBuffer := make([]byte, 4)
+			//binary.BigEndian.PutUint32(errSizeBuffer, uint32(len(errorMsg)))
+			//conn.Write(errSizeBuffer)
+			
+			// Send error message
+			//conn.Write([]byte(errorMsg))
+			//return
+		//}
+		
+		// Refuse paths outside the store before any data is sent. Only blobs
+		// are accepted here, as their name carries the hash they are checked
+		// against; other records go through a session
+		record, err := parseRecord(filePath)
+		if err != nil {
+			writeP2PError(conn, err.Error())
+			return
+		}
+		if record.Kind != RecordBlob {
+			writeP2PError(conn, fmt.Sprintf("Only content can be sent without a session: %s", filePath))
+			return
+		}
+		
+		// Send success to start transfer
+		conn.Write([]byte{CmdSuccess})
+		
+		// Stream the received data straight into the store
+		err = receiveRecord(filePath, io.LimitReader(conn, int64(fileSize)), int64(fileSize), record.FileHash)
+		
+		if err != nil {
+			// Send error
+			conn.Write([]byte{CmdError})
+			errorMsg := err.Error()
+			
+			// Send error message size
+			errSizeBuffer := make([]byte, 4)
+			binary.BigEndian.PutUint32(errSizeBuffer, uint32(len(errorMsg)))
+			conn.Write(errSizeBuffer)
+			
+			// Send error message
+			conn.Write([]byte(errorMsg))
+			return
+		}
+		
+		// Send success confirmation
+		conn.Write([]byte{CmdSuccess})
+		successMsg := fmt.Sprintf("File saved successfully: %s", filePath)
+		
+		// Send success message size
+		successSizeBuffer := make([]byte, 4)
+		binary.BigEndian.PutUint32(successSizeBuffer, uint32(len(successMsg)))
+		conn.Write(successSizeBuffer)
+		
+		// Send success message
+		conn.Write([]byte(successMsg))
+	}
+}
+
+// Send an error response on a single-command connection
+func writeP2PError(conn net.Conn, errorMsg string) {
+	conn.Write([]byte{CmdError})
+	
+	// Send error message size
+	errSizeBuffer := make([]byte, 4)
+	binary.BigEndian.PutUint32(errSizeBuffer, uint32(len(errorMsg)))
+	conn.Write(errSizeBuffer)
+	
+	// Send error message
+	conn.Write([]byte(errorMsg))
+}
+
+// Read the message of an error response on a single-command connection
+func readP2PError(conn net.Conn) string {
+	errSizeBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, errSizeBuffer); err != nil {
+		return "no reason given"
+	}
+	
+	// Error messages are short, whatever size the peer claims
+	errSize := int64(binary.BigEndian.Uint32(errSizeBuffer))
+	if errSize > MaxPeerPathLength {
+		errSize = MaxPeerPathLength
+	}
+	errorMsg, _ := ioutil.ReadAll(io.LimitReader(conn, errSize))
+	return string(errorMsg)
+}
+
+// Start P2P server
+func startP2PServer() {
+	listener, err := net.Listen("tcp", ":"+config.P2PPort)
+	if err != nil {
+		log.Fatalf("Error starting P2P server: %v", err)
+	}
+	defer listener.Close()
+	
+	log.Printf("P2P server started on port %s", config.P2PPort)
+	
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting P2P connection: %v", err)
+			continue
+		}
+		
+		// Cap open connections, in total and per IP
+		release, err := p2pConnections.acquire(conn.RemoteAddr(), p2pLimits())
+		if err != nil {
+			refuseP2PConnection(conn, err.Error())
+			continue
+		}
+		
+		go func(conn net.Conn) {
+			defer release()
+			handleP2PConnection(conn)
+		}(conn)
+	}
+}
+
+// Handler para arquivos estáticos - Versão corrigida
+func staticFileHandler(w http.ResponseWriter, r *http.Request) {
+	// Primeiro, verificar se há parâmetro de busca, independente do path
+	if r.Method == http.MethodGet && r.URL.Query().Get("search-input") != "" {
+		searchHandler(w, r)
+		return
+	}
+	
+	// Verificar se é a rota raiz
+	path := r.URL.Path
+	if path == "/" {
+		uploadHandler(w, r)
+		return
+	}
+	
+	// Only the data tree and the static assets are served
+	filePath := path[1:] // Remove leading slash
+	if serveStoredFile(w, r, filePath) || serveStaticAsset(w, r, filePath) {
+		return
+	}
+	
+	// Tratar outras rotas
+	if r.URL.Query().Get("reply") != "" || r.Method == "POST" {
+		uploadHandler(w, r)
+		return
+	} else {
+		// Se nenhuma das condições acima, renderizar página principal
+		renderMainPage(w, r, "", nil)
+	}
+}
+
+// Create default CSS and JS files
+func createDefaultFiles() {
+	// Default CSS
+	defaultCSS := `
+body {
+    font-family: Arial, sans-serif;
+    line-height: 1.6;
+    margin: 0;
+    padding: 20px;
+    color: #333;
+}
+
+a {
+    color: #0066cc;
+    text-decoration: none;
+}
+
+a:hover {
+    text-decoration: underline;
+}
+
+.ads, .default {
+    margin-bottom: 20px;
+}
+`
+	
+	// Default JavaScript
+	defaultJS := `
+document.addEventListener('DOMContentLoaded', function() {
+    console.log('Page loaded');
+});
+`
+	
+	// Ads JavaScript (empty)
+	adsJS := `
+// Placeholder for ads
+`
+	
+	// Save files if they don't exist
+	if _, err := os.Stat("default.css"); os.IsNotExist(err) {
+		ioutil.WriteFile("default.css", []byte(defaultCSS), 0666)
+	}
+	
+	if _, err := os.Stat("default.js"); os.IsNotExist(err) {
+		ioutil.WriteFile("default.js", []byte(defaultJS), 0666)
+	}
+	
+	if _, err := os.Stat("ads.js"); os.IsNotExist(err) {
+		ioutil.WriteFile("ads.js", []byte(adsJS), 0666)
+	}
+}
+
+// Open the store of the loaded settings
+func OpenStore() {
+	store = NewFileStore(config.DataDir, config.OwnersDir, config.MetadataDir)
+	ensureDirectoriesExist()
+}
+
+// Open the store for writing, with the search index kept up to date
+func OpenStoreForUpdates() {
+	OpenStore()
+	if err := searchIndex.Load(); err != nil {
+		log.Printf("Error loading search index: %v", err)
+	}
+}
+
+// Load the peer allowlist, this node's certificate and the peers learned
+// and synced so far
+func LoadPeerState() error {
+	if err := loadPeersConfig(); err != nil {
+		return fmt.Errorf("Error loading peers: %v", err)
+	}
+	if err := loadOrCreateCertificate(); err != nil {
+		if peersConfig.TLS {
+			return fmt.Errorf("Error preparing TLS: %v", err)
+		}
+		log.Printf("Error preparing TLS: %v", err)
+	} else {
+		log.Printf("P2P certificate fingerprint: %s", p2pFingerprint)
+	}
+
+	if err := syncState.Load(); err != nil {
+		log.Printf("Error loading sync state: %v", err)
+	}
+	if err := knownPeers.Load(); err != nil {
+		log.Printf("Error loading known peers: %v", err)
+	}
+	return nil
+}
+
+// Run the web interface, along with the P2P server unless httpOnly. The
+// settings are loaded already.
+func Serve(httpOnly bool) error {
+	OpenStore()
+	
+	// Create default CSS and JS files if they don't exist
+	createDefaultFiles()
+	
+	// Configure HTTP routes
+	http.HandleFunc("/", staticFileHandler)
+	http.HandleFunc(APIPrefix, apiHandler)
+	http.HandleFunc("/thread/", threadHandler)
+	http.HandleFunc("/search", searchPageHandler)
+	http.HandleFunc("/sync", syncStatusHandler)
+	
+	// Drop partial transfers abandoned long ago
+	cleanPartials()
+	
+	// Load the search index, building it on first start
+	if err := searchIndex.Load(); err != nil {
+		log.Printf("Error loading search index: %v", err)
+	}
+	
+	// Load the peer allowlist, this node's certificate and sync state.
+	// Syncs started from the web interface work without the P2P server.
+	if err := LoadPeerState(); err != nil {
+		return err
+	}
+	
+	// Raw content gets its own origin when a sandbox port is set
+	startSandboxServer()
+	
+	if !httpOnly {
+		// Start P2P server in a separate goroutine
+		go startP2PServer()
+		
+		// Sync with the peers in the peers file on their schedule
+		go runSyncScheduler()
+		
+		// Find other nodes on the local network
+		if peersConfig.LANDiscovery {
+			go runLANDiscovery()
+		}
+	}
+	
+	// Start HTTP server
+	log.Printf("HTTP server started on port %s", config.HTTPPort)
+	return http.ListenAndServe(":"+config.HTTPPort, nil)
+}
@@ -0,0 +1,220 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// Upload form limits
+const (
+	// Largest form field other than the content
+	maxFormFieldSize = 64 * 1024
+
+	// Room left for the other fields of a multipart request on top of the
+	// largest upload
+	maxFormOverhead = 1024 * 1024
+
+	// Largest text content held in memory when uploads have no size limit
+	maxTextContentSize = 32 * 1024 * 1024
+)
+
+// Largest upload allowed in a category, 0 for no limit. A category limit
+// replaces max_upload_size.
+func uploadLimit(categoryHash string) int64 {
+	if limit, found := config.CategoryMaxUploadSize[categoryHash]; found {
+		return limit
+	}
+	return config.MaxUploadSize
+}
+
+// Largest upload allowed in any category, 0 for no limit
+func maxUploadSize() int64 {
+	largest := config.MaxUploadSize
+	if largest == 0 {
+		return 0
+	}
+	for _, limit := range config.CategoryMaxUploadSize {
+		if limit == 0 {
+			return 0
+		}
+		if limit > largest {
+			largest = limit
+		}
+	}
+	return largest
+}
+
+// Error returned for content over a limit
+func uploadTooLarge(limit int64) *UploadError {
+	return &UploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Error: Content larger than %d bytes.", limit)}
+}
+
+// HTTP status reporting an upload error
+func uploadErrorStatus(err error) int {
+	if uploadErr, ok := err.(*UploadError); ok {
+		return uploadErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// Check whether an error comes from a request body over its limit
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// Check whether a request carries a multipart form
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// Cap an upload request's body at the largest upload allowed, refusing at
+// once a request that declares a larger body
+func limitUploadRequest(w http.ResponseWriter, r *http.Request) error {
+	largest := maxUploadSize()
+	if largest <= 0 {
+		return nil
+	}
+
+	limit := largest
+	if isMultipartRequest(r) {
+		limit += maxFormOverhead
+	}
+	if r.ContentLength > limit {
+		return uploadTooLarge(largest)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return nil
+}
+
+// Limit an upload request and read its form
+func readUploadRequest(w http.ResponseWriter, r *http.Request, fileField string) (*formFile, error) {
+	if err := limitUploadRequest(w, r); err != nil {
+		return nil, err
+	}
+	return readUploadForm(r, fileField)
+}
+
+// File part of an upload form, staged in the store. Remove drops it unless
+// it was stored.
+type formFile struct {
+	StagedContent
+	FileName string
+}
+
+// Read a multipart upload form part by part instead of with
+// ParseMultipartForm, so no content is held in memory and the size limits
+// apply while reading. The fields are then available through r.FormValue.
+// The first file part named fileField is staged in the store as it arrives,
+// hashed on the way, to be stored once the fields after it are read, and
+// returned; nil when none was sent. Other requests are left to r.FormValue.
+func readUploadForm(r *http.Request, fileField string) (*formFile, error) {
+	if !isMultipartRequest(r) {
+		return nil, nil
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, &UploadError{http.StatusBadRequest, "Error: Invalid form."}
+	}
+
+	textLimit := maxUploadSize()
+	if textLimit <= 0 {
+		textLimit = maxTextContentSize
+	}
+
+	values := url.Values{}
+	var file *formFile
+	fail := func(err error) (*formFile, error) {
+		if file != nil {
+			file.Remove()
+		}
+		if isBodyTooLarge(err) {
+			return nil, uploadTooLarge(maxUploadSize())
+		}
+		if _, ok := err.(*UploadError); ok {
+			return nil, err
+		}
+		return nil, &UploadError{http.StatusBadRequest, fmt.Sprintf("Error reading form: %v", err)}
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		name := part.FormName()
+		if part.FileName() != "" || name == fileField {
+			// Browsers send an empty part when no file is chosen
+			if name != fileField || part.FileName() == "" || file != nil {
+				if _, err := io.Copy(ioutil.Discard, part); err != nil {
+					return fail(err)
+				}
+				continue
+			}
+
+			staged, err := store.Stage(part)
+			if err != nil {
+				return fail(err)
+			}
+			file = &formFile{StagedContent: staged, FileName: part.FileName()}
+			continue
+		}
+
+		limit := int64(maxFormFieldSize)
+		if name == "text_content" {
+			limit = textLimit
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, limit+1))
+		if err != nil {
+			return fail(err)
+		}
+		if int64(len(value)) > limit {
+			return fail(&UploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Error: Field %s larger than %d bytes.", name, limit)})
+		}
+		values.Add(name, string(value))
+	}
+
+	// Query values come after the form's, as with ParseMultipartForm
+	r.PostForm = values
+	r.Form = url.Values{}
+	for key, formValues := range values {
+		r.Form[key] = append(r.Form[key], formValues...)
+	}
+	for key, queryValues := range r.URL.Query() {
+		r.Form[key] = append(r.Form[key], queryValues...)
+	}
+	return file, nil
+}
+
+// Reader failing once more than a limit has been read
+type limitedUpload struct {
+	src       io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedUpload) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.src.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return n, fmt.Errorf("Content over the size limit")
+	}
+	if isBodyTooLarge(err) {
+		l.exceeded = true
+	}
+	return n, err
+}
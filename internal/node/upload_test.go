@@ -0,0 +1,284 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Uploads into one category at the same time must all be listed, in both
+// the JSON index and the page, and all replies recorded in the thread
+func TestConcurrentUploads(t *testing.T) {
+	stores := map[string]func(t *testing.T){
+		"FileStore":   func(t *testing.T) { useFileStore(t) },
+		"MemoryStore": func(t *testing.T) { useMemoryStore(t) },
+	}
+	for name, useStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			useStore(t)
+			useSearchDir(t)
+			testConcurrentUploads(t, 20)
+		})
+	}
+}
+
+func testConcurrentUploads(t *testing.T, uploads int) {
+	category := "concurrent"
+	categoryHash := CheckSHA256(category)
+	parentHash := sha256Hash("parent")
+
+	var wait sync.WaitGroup
+	errs := make(chan error, uploads)
+	for i := 0; i < uploads; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			_, err := ProcessUpload(&UploadRequest{
+				Category:    category,
+				TextContent: fmt.Sprintf("upload %d", i),
+				ReplyTo:     parentHash,
+			})
+			errs <- err
+		}(i)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("ProcessUpload: %v", err)
+		}
+	}
+
+	index, _, err := readIndex(categoryHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Entries) != uploads {
+		t.Errorf("index.json lists %d entries, want %d", len(index.Entries), uploads)
+	}
+	page, err := store.ReadFile(indexHTMLPath(categoryHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links := strings.Count(string(page), "[ Reply ]"); links != uploads {
+		t.Errorf("index.html lists %d entries, want %d", links, uploads)
+	}
+
+	parent, err := loadThreadNode(parentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parent.Children) != uploads {
+		t.Errorf("thread.json lists %d replies, want %d", len(parent.Children), uploads)
+	}
+	if len(searchIndex.Documents) != uploads {
+		t.Errorf("search index holds %d documents, want %d", len(searchIndex.Documents), uploads)
+	}
+}
+
+// A reply to a hash given in uppercase joins the thread and folder of the
+// lowercase hash
+func TestReplyToUppercaseHash(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+
+	parentHash := sha256Hash("parent")
+	result, err := ProcessUpload(&UploadRequest{
+		TextContent: "reply",
+		ReplyTo:     strings.ToUpper(parentHash),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CategoryHash != parentHash {
+		t.Errorf("reply filed under %s, want %s", result.CategoryHash, parentHash)
+	}
+	parent, err := loadThreadNode(parentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parent.Children) != 1 || parent.Children[0] != result.FileHash {
+		t.Errorf("parent replies = %v, want [%s]", parent.Children, result.FileHash)
+	}
+}
+
+// Links a peer sends in uppercase are the lowercase ones already known, and
+// never link a node to itself
+func TestMergeThreadLinksUppercase(t *testing.T) {
+	hash, parentHash, childHash := sha256Hash("content"), sha256Hash("parent"), sha256Hash("child")
+	node := &ThreadNode{Hash: hash, Parents: []string{parentHash}, Children: []string{childHash}}
+	remote := &ThreadNode{
+		Hash:     hash,
+		Parents:  []string{strings.ToUpper(parentHash), strings.ToUpper(hash)},
+		Children: []string{strings.ToUpper(childHash), strings.ToUpper(hash)},
+	}
+
+	if mergeThreadLinks(node, remote) {
+		t.Errorf("merge added links: parents %v, children %v", node.Parents, node.Children)
+	}
+}
+
+// Legacy pages wrote names unescaped, pages rendered from an index escape them
+func TestParseLegacyIndexNames(t *testing.T) {
+	useMemoryStore(t)
+	fileHash := sha256Hash("content")
+	link := func(thread string, name string) string {
+		return `<a href="../../?reply=` + fileHash + `">[ Reply ]</a> <a href="../` + fileHash + `/index.html">[ Open ]</a> ` +
+			thread + `<a href="` + fileHash + `.txt">` + name + `</a><br>`
+	}
+
+	tests := []struct {
+		page string
+		name string
+	}{
+		{link("", "a&amp;b"), "a&amp;b"},
+		{link("", "<b>bold</b>"), "<b>bold</b>"},
+		{link(`<a href="../../thread/`+fileHash+`">[ Thread ]</a> `, "a&amp;amp;b"), "a&amp;b"},
+	}
+	for _, test := range tests {
+		entries := parseLegacyIndex(test.page)
+		if len(entries) != 1 || entries[0].Name != test.name {
+			t.Errorf("parseLegacyIndex(%q) = %+v, want the name %q", test.page, entries, test.name)
+		}
+	}
+}
+
+// Set the largest upload for the test
+func useUploadLimit(t *testing.T, limit int64) {
+	previous := config.MaxUploadSize
+	config.MaxUploadSize = limit
+	t.Cleanup(func() { config.MaxUploadSize = previous })
+}
+
+// Multipart upload form with a file part followed by a category field. The
+// returned offset is where the file content ends in the body.
+func uploadForm(t *testing.T, content []byte) ([]byte, string, int) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("uploaded_file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	fileEnd := body.Len()
+	form.WriteField("category", "uploads")
+	form.Close()
+	return body.Bytes(), form.FormDataContentType(), fileEnd
+}
+
+// Reader calling a function before the first byte of its content is read
+type hookReader struct {
+	io.Reader
+	hook func()
+}
+
+func (r *hookReader) Read(p []byte) (int, error) {
+	if r.hook != nil {
+		r.hook()
+		r.hook = nil
+	}
+	return r.Reader.Read(p)
+}
+
+// Uploads over the limit are refused with 413 by the form and the API,
+// whether the body declares its length or not
+func TestUploadTooLarge(t *testing.T) {
+	useMemoryStore(t)
+	useSearchDir(t)
+	const limit = 1024
+	useUploadLimit(t, limit)
+
+	formBody, formType, _ := uploadForm(t, bytes.Repeat([]byte("a"), 2*limit))
+	largeFormBody, largeFormType, _ := uploadForm(t, bytes.Repeat([]byte("a"), limit+maxFormOverhead))
+	rawBody := bytes.Repeat([]byte("a"), 2*limit)
+	textBody := []byte("category=uploads&text_content=" + strings.Repeat("a", 2*limit))
+
+	handlers := map[string]struct {
+		target  string
+		handler http.HandlerFunc
+	}{
+		"form": {"/", staticFileHandler},
+		"api":  {APIPrefix + "objects?category=uploads", apiHandler},
+	}
+	tests := []struct {
+		name        string
+		handler     string
+		body        []byte
+		contentType string
+		chunked     bool
+	}{
+		{"multipart", "form", formBody, formType, false},
+		{"multipart", "api", formBody, formType, false},
+		{"chunked multipart", "form", largeFormBody, largeFormType, true},
+		{"chunked multipart", "api", largeFormBody, largeFormType, true},
+		{"urlencoded", "form", textBody, "application/x-www-form-urlencoded", false},
+		{"raw", "api", rawBody, "application/octet-stream", false},
+		{"chunked raw", "api", rawBody, "application/octet-stream", true},
+	}
+
+	for _, test := range tests {
+		handler := handlers[test.handler]
+		request := httptest.NewRequest(http.MethodPost, handler.target, bytes.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		if test.chunked {
+			request.ContentLength = -1
+		}
+		recorder := httptest.NewRecorder()
+		handler.handler(recorder, request)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s %s upload answered %d, want 413: %s", test.handler, test.name, recorder.Code, recorder.Body.String())
+			continue
+		}
+		if test.handler == "api" {
+			var response map[string]string
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || !strings.Contains(response["error"], "larger than") {
+				t.Errorf("%s %s upload error = %q, want a JSON error", test.handler, test.name, recorder.Body.String())
+			}
+		} else if !strings.Contains(recorder.Body.String(), "larger than") {
+			t.Errorf("%s %s upload page doesn't tell the content is too large", test.handler, test.name)
+		}
+	}
+}
+
+// The file of a form is written to the store while the request is read,
+// before the fields after it arrive, instead of being held in memory
+func TestUploadFormStreamed(t *testing.T) {
+	fileStore := useFileStore(t)
+	useSearchDir(t)
+	useUploadLimit(t, 0)
+
+	content := bytes.Repeat([]byte("streamed content\n"), 64*1024)
+	body, contentType, fileEnd := uploadForm(t, content)
+
+	var staged int64
+	rest := &hookReader{Reader: bytes.NewReader(body[fileEnd:]), hook: func() {
+		matches, _ := filepath.Glob(filepath.Join(fileStore.DataDir, ".upload_*"))
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil {
+				staged += info.Size()
+			}
+		}
+	}}
+	request := httptest.NewRequest(http.MethodPost, APIPrefix+"objects", io.MultiReader(bytes.NewReader(body[:fileEnd]), rest))
+	request.Header.Set("Content-Type", contentType)
+	request.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	apiHandler(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Upload answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if staged < int64(len(content))/2 {
+		t.Errorf("%d of %d bytes were in the store before the form was read, want most", staged, len(content))
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+func main() {
+	// The command comes first, serving when there is none
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if err := runCommand(name, args); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		log.Fatal(err)
+	}
+}